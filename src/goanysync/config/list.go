@@ -0,0 +1,113 @@
+// Copyright (C) 2012 Esa Määttä <esa.maatta@iki.fi>
+// This file is released under the GNU GPL, version 3 or a later revision.
+// For further details see the COPYING file.
+
+package config
+
+import (
+    "errors"
+    "strings"
+    "unicode"
+)
+
+const (
+    LIST_SEPARATOR = ','
+    QUOTE          = '"'
+    ESCAPE         = '\\'
+)
+
+// ParseList parses a list option value. List entries are separated by commas
+// or newlines. Whitespace around an entry is removed unless the entry, or a
+// part of it, is in double quotes. A backslash escapes the following
+// character, inside and outside of quotes. Empty entries are skipped.
+//
+// For example the value `/a, "/b, with comma", /c\,d , " /e "` gives entries
+// "/a", "/b, with comma", "/c,d" and " /e ".
+func ParseList(value string) ([]string, error) { // {{{
+    var (
+        list    []string
+        entry   []rune
+        literal []bool // Whether the rune at the same index in entry was quoted or escaped
+        quoted  bool
+        escaped bool
+    )
+
+    // Helper function to add the current entry to the list
+    endEntry := func() {
+        start, end := 0, len(entry)
+        for start < end && !literal[start] && unicode.IsSpace(entry[start]) {
+            start++
+        }
+        for end > start && !literal[end-1] && unicode.IsSpace(entry[end-1]) {
+            end--
+        }
+        if start < end {
+            list = append(list, string(entry[start:end]))
+        }
+        entry, literal = entry[:0], literal[:0]
+    }
+
+    for _, r := range value {
+        switch {
+        case escaped:
+            entry, literal = append(entry, r), append(literal, true)
+            escaped = false
+        case r == ESCAPE:
+            escaped = true
+        case r == QUOTE:
+            quoted = !quoted
+        case quoted:
+            entry, literal = append(entry, r), append(literal, true)
+        case r == LIST_SEPARATOR || r == '\n':
+            endEntry()
+        default:
+            entry, literal = append(entry, r), append(literal, false)
+        }
+    }
+
+    if escaped {
+        return nil, errors.New("List ends with an escape character: " + value)
+    }
+    if quoted {
+        return nil, errors.New("Unterminated quote in list: " + value)
+    }
+    endEntry()
+    return list, nil
+}   // }}}
+
+// QuoteListEntry returns given list entry quoted, if needed, so that ParseList
+// gives the entry back as it is.
+func QuoteListEntry(entry string) string { // {{{
+    special := string([]rune{LIST_SEPARATOR, QUOTE, ESCAPE, COMMENT, '\n'})
+    if entry != "" && strings.TrimSpace(entry) == entry && !strings.ContainsAny(entry, special) {
+        return entry
+    }
+    escaper := strings.NewReplacer(string(ESCAPE), string([]rune{ESCAPE, ESCAPE}), string(QUOTE), string([]rune{ESCAPE, QUOTE}))
+    return string(QUOTE) + escaper.Replace(entry) + string(QUOTE)
+}   // }}}
+
+// continuesList checks whether given option value ends with an unquoted and
+// unescaped list separator, meaning the list continues on the next line.
+func continuesList(value string) bool { // {{{
+    var quoted, escaped, separator bool
+    for _, r := range value {
+        switch {
+        case escaped:
+            escaped = false
+            separator = false
+        case r == ESCAPE:
+            escaped = true
+        case r == QUOTE:
+            quoted = !quoted
+            separator = false
+        case quoted:
+        case r == LIST_SEPARATOR:
+            separator = true
+        case !unicode.IsSpace(r):
+            separator = false
+        }
+    }
+    return separator && !quoted && !escaped
+}   // }}}
+
+// vim: set sts=4 ts=4 sw=4 et foldmethod=marker:
@@ -0,0 +1,149 @@
+// Copyright (C) 2012 Esa Määttä <esa.maatta@iki.fi>
+// This file is released under the GNU GPL, version 3 or a later revision.
+// For further details see the COPYING file.
+
+package config
+
+import (
+    "reflect"
+    "testing"
+)
+
+func TestParseList(t *testing.T) { // {{{
+    tests := []struct {
+        value string
+        want  []string
+    }{
+        {``, nil},
+        {`/a`, []string{"/a"}},
+        {`/a,/b`, []string{"/a", "/b"}},
+        {` /a , /b `, []string{"/a", "/b"}},
+        {"/a\n/b", []string{"/a", "/b"}},
+        {"/a,\n /b,\n/c", []string{"/a", "/b", "/c"}},
+        {`/a b, /c`, []string{"/a b", "/c"}},
+        // Quoted entries
+        {`"/a, b", /c`, []string{"/a, b", "/c"}},
+        {`" /a ", /b`, []string{" /a ", "/b"}},
+        {`/a" b "c`, []string{"/a b c"}},
+        {`"/a"/b`, []string{"/a/b"}},
+        {`"#a"`, []string{"#a"}},
+        // Escapes
+        {`/a\,b`, []string{"/a,b"}},
+        {`/a\"b`, []string{`/a"b`}},
+        {`/a\\,/b`, []string{`/a\`, "/b"}},
+        {`"/a\"b"`, []string{`/a"b`}},
+        {`"/a\\"`, []string{`/a\`}},
+        {`\ /a`, []string{" /a"}},
+        // Empty entries are skipped
+        {`,`, nil},
+        {`/a,,/b`, []string{"/a", "/b"}},
+        {`/a, ,/b,`, []string{"/a", "/b"}},
+        {"\n/a\n\n", []string{"/a"}},
+        {`""`, nil},
+        {`/a, "", /b`, []string{"/a", "/b"}},
+        // Example in the doc comment
+        {`/a, "/b, with comma", /c\,d , " /e "`, []string{"/a", "/b, with comma", "/c,d", " /e "}},
+    }
+    for _, test := range tests {
+        got, err := ParseList(test.value)
+        if err != nil {
+            t.Errorf("ParseList(%q): unexpected error: %s", test.value, err)
+            continue
+        }
+        if !reflect.DeepEqual(got, test.want) {
+            t.Errorf("ParseList(%q) = %q, want %q", test.value, got, test.want)
+        }
+    }
+}   // }}}
+
+func TestParseListErrors(t *testing.T) { // {{{
+    tests := []string{
+        `"/a`,
+        `/a, "/b`,
+        `"/a\"`,
+        `/a\`,
+        `/a, /b\`,
+        `"/a"\`,
+    }
+    for _, value := range tests {
+        if got, err := ParseList(value); err == nil {
+            t.Errorf("ParseList(%q) = %q, want an error", value, got)
+        }
+    }
+}   // }}}
+
+func TestQuoteListEntry(t *testing.T) { // {{{
+    tests := []struct {
+        entry string
+        want  string
+    }{
+        {`/a`, `/a`},
+        {`/a b`, `/a b`},
+        {``, `""`},
+        {` /a`, `" /a"`},
+        {`/a `, `"/a "`},
+        {`/a,b`, `"/a,b"`},
+        {`/a"b`, `"/a\"b"`},
+        {`/a\b`, `"/a\\b"`},
+        {`/a#b`, `"/a#b"`},
+    }
+    for _, test := range tests {
+        if got := QuoteListEntry(test.entry); got != test.want {
+            t.Errorf("QuoteListEntry(%q) = %s, want %s", test.entry, got, test.want)
+        }
+    }
+}   // }}}
+
+func TestQuoteListEntryRoundTrip(t *testing.T) { // {{{
+    entries := []string{
+        `/a`,
+        `/a b`,
+        ` /a `,
+        "\t/a",
+        `/a,b`,
+        `/a"b`,
+        `/a\b`,
+        `/a\`,
+        `\"`,
+        `/a #b`,
+        `"/a"`,
+        "/a\nb",
+        `/ä, ö`,
+    }
+    for _, entry := range entries {
+        quoted := QuoteListEntry(entry)
+        got, err := ParseList(quoted)
+        if err != nil {
+            t.Errorf("ParseList(QuoteListEntry(%q)): unexpected error: %s", entry, err)
+            continue
+        }
+        if want := []string{entry}; !reflect.DeepEqual(got, want) {
+            t.Errorf("ParseList(%s) = %q, want %q", quoted, got, want)
+        }
+    }
+}   // }}}
+
+func TestContinuesList(t *testing.T) { // {{{
+    tests := []struct {
+        value string
+        want  bool
+    }{
+        {``, false},
+        {`/a`, false},
+        {`/a,`, true},
+        {`/a, `, true},
+        {`/a,/b`, false},
+        {`/a\,`, false},
+        {`/a\\,`, true},
+        {`"/a,`, false},
+        {`"/a,"`, false},
+        {`"/a",`, true},
+    }
+    for _, test := range tests {
+        if got := continuesList(test.value); got != test.want {
+            t.Errorf("continuesList(%q) = %t, want %t", test.value, got, test.want)
+        }
+    }
+}   // }}}
+
+// vim: set sts=4 ts=4 sw=4 et foldmethod=marker:
@@ -0,0 +1,51 @@
+// Copyright (C) 2012 Esa Määttä <esa.maatta@iki.fi>
+// This file is released under the GNU GPL, version 3 or a later revision.
+// For further details see the COPYING file.
+
+package config
+
+// Merge merges options and sections from other config to the config. Values
+// of options named in lists are appended to the existing values, separated by
+// a newline, and other options in other replace the existing ones. Sections
+// with the same name and argument are merged in the same way, others are
+// appended.
+func (self *Config) Merge(other *Config, lists []string) { // {{{
+    mergeData(self.Data, self.Origins, other.Data, other.Origins, lists)
+
+    for _, osec := range other.Sections {
+        var section *Section
+        for _, s := range self.Sections {
+            if s.Name == osec.Name && s.Arg == osec.Arg {
+                section = s
+                break
+            }
+        }
+        if section == nil {
+            section = &Section{osec.Name, osec.Arg, nil, make(map[string]*string), make(map[string][]string)}
+            self.Sections = append(self.Sections, section)
+        }
+        section.Origin = append(section.Origin, osec.Origin...)
+        mergeData(section.Data, section.Origins, osec.Data, osec.Origins, lists)
+    }
+}   // }}}
+
+// mergeData merges option values and their origins from other data to data.
+func mergeData(data map[string]*string, origins map[string][]string, odata map[string]*string, oorigins map[string][]string, lists []string) { // {{{
+    for option, value := range odata {
+        isList := false
+        for _, l := range lists {
+            isList = isList || l == option
+        }
+        if old, ok := data[option]; ok && isList {
+            v := *old + "\n" + *value
+            data[option] = &v
+            origins[option] = append(origins[option], oorigins[option]...)
+            continue
+        }
+        v := *value
+        data[option] = &v
+        origins[option] = oorigins[option]
+    }
+}   // }}}
+
+// vim: set sts=4 ts=4 sw=4 et foldmethod=marker:
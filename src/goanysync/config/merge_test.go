@@ -0,0 +1,140 @@
+// Copyright (C) 2012 Esa Määttä <esa.maatta@iki.fi>
+// This file is released under the GNU GPL, version 3 or a later revision.
+// For further details see the COPYING file.
+
+package config
+
+import (
+    "os"
+    "path/filepath"
+    "reflect"
+    "testing"
+)
+
+// readTestConfig writes content to file name in dir and reads it.
+func readTestConfig(t *testing.T, dir, name, content string) *Config { // {{{
+    fn := filepath.Join(dir, name)
+    if err := os.WriteFile(fn, []byte(content), 0644); err != nil {
+        t.Fatal(err)
+    }
+    c, err := Read(fn, []string{"WHATTOSYNC", "EXCLUDE"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    return c
+}   // }}}
+
+func TestMerge(t *testing.T) { // {{{
+    dir := t.TempDir()
+    lists := []string{"WHATTOSYNC", "EXCLUDE"}
+    c := readTestConfig(t, dir, "main.conf", `TMPFS = /tmp
+WHATTOSYNC = /a, /b
+LOCKFILE = /run/lock
+
+[path /a]
+MODE = bind
+EXCLUDE = *.tmp
+`)
+    c.Merge(readTestConfig(t, dir, "10-first.conf", `WHATTOSYNC = /c
+TMPFS = /dev/shm
+SYNCER = go
+
+[path /a]
+EXCLUDE = *.log
+SYNC_INTERVAL = 5m
+
+[path /c]
+MODE = overlay
+`), lists)
+    c.Merge(readTestConfig(t, dir, "20-second.conf", `WHATTOSYNC = /d,
+    /e
+TMPFS = /run/shm
+
+[path /c]
+MODE = bind
+
+[path /a]
+MODE = overlay
+`), lists)
+
+    first := filepath.Join(dir, "10-first.conf")
+    second := filepath.Join(dir, "20-second.conf")
+    main := filepath.Join(dir, "main.conf")
+    tests := []struct {
+        data    map[string]*string
+        origins map[string][]string
+        option  string
+        want    string
+        origin  []string
+    }{
+        // Lists are appended in merge order
+        {c.Data, c.Origins, "WHATTOSYNC", "/a, /b\n/c\n/d,\n/e", []string{main + ":2", first + ":1", second + ":1"}},
+        // Other options are replaced by the last config defining them
+        {c.Data, c.Origins, "TMPFS", "/run/shm", []string{second + ":3"}},
+        {c.Data, c.Origins, "SYNCER", "go", []string{first + ":3"}},
+        {c.Data, c.Origins, "LOCKFILE", "/run/lock", []string{main + ":3"}},
+    }
+    for _, test := range tests {
+        v, ok := test.data[test.option]
+        if !ok {
+            t.Errorf("Merged %s not defined", test.option)
+            continue
+        }
+        if *v != test.want {
+            t.Errorf("Merged %s = %q, want %q", test.option, *v, test.want)
+        }
+        if got := test.origins[test.option]; !reflect.DeepEqual(got, test.origin) {
+            t.Errorf("Merged %s origins = %q, want %q", test.option, got, test.origin)
+        }
+    }
+    entries, err := ParseList(*c.Data["WHATTOSYNC"])
+    if err != nil {
+        t.Fatal(err)
+    }
+    if want := []string{"/a", "/b", "/c", "/d", "/e"}; !reflect.DeepEqual(entries, want) {
+        t.Errorf("Merged WHATTOSYNC entries = %q, want %q", entries, want)
+    }
+
+    // Sections with the same name and argument are merged, others appended
+    var sections []string
+    for _, s := range c.Sections {
+        sections = append(sections, s.Name+" "+s.Arg)
+    }
+    if want := []string{"path /a", "path /c"}; !reflect.DeepEqual(sections, want) {
+        t.Fatalf("Merged sections = %q, want %q", sections, want)
+    }
+    a, cs := c.Sections[0], c.Sections[1]
+    if want := []string{main + ":5", first + ":5", second + ":8"}; !reflect.DeepEqual(a.Origin, want) {
+        t.Errorf("Merged section origins = %q, want %q", a.Origin, want)
+    }
+    want := map[string]string{"MODE": "overlay", "EXCLUDE": "*.tmp\n*.log", "SYNC_INTERVAL": "5m"}
+    got := make(map[string]string)
+    for option, v := range a.Data {
+        got[option] = *v
+    }
+    if !reflect.DeepEqual(got, want) {
+        t.Errorf("Merged section [path /a] = %q, want %q", got, want)
+    }
+    if v, ok := cs.Data["MODE"]; !ok || *v != "bind" {
+        t.Errorf("Merged section [path /c] MODE = %v, want %q", v, "bind")
+    }
+}   // }}}
+
+func TestMergeCopiesValues(t *testing.T) { // {{{
+    dir := t.TempDir()
+    c := readTestConfig(t, dir, "main.conf", "TMPFS = /tmp\n")
+    other := readTestConfig(t, dir, "drop-in.conf", "TMPFS = /dev/shm\nWHATTOSYNC = /a\n")
+    c.Merge(other, []string{"WHATTOSYNC"})
+
+    // Changing the result does not change the config merged into it
+    *c.Data["TMPFS"] = "/changed"
+    *c.Data["WHATTOSYNC"] = "/changed"
+    if v := *other.Data["TMPFS"]; v != "/dev/shm" {
+        t.Errorf("Drop-in TMPFS = %q after change, want %q", v, "/dev/shm")
+    }
+    if v := *other.Data["WHATTOSYNC"]; v != "/a" {
+        t.Errorf("Drop-in WHATTOSYNC = %q after change, want %q", v, "/a")
+    }
+}   // }}}
+
+// vim: set sts=4 ts=4 sw=4 et foldmethod=marker:
@@ -6,8 +6,7 @@ package config
 
 import (
     "bufio"
-    "errors"
-    "io"
+    "fmt"
     "os"
     "strings"
     "unicode"
@@ -16,62 +15,258 @@ import (
 type Config struct {
     // option -> value
     Data map[string]*string
+    // option -> "file:line" positions where the value was read from
+    Origins map[string][]string
+    // Sections in the order they appear in the file
+    Sections []*Section
+    // Lines of the file, so that it can be written back with comments and
+    // option order intact
+    Lines []*Line
+    // Names of the options whose values are lists
+    Lists []string
+}
+
+// Section is a group of options started with a "[name arg]" line. Options
+// after the line belong to the section until the next section line.
+type Section struct {
+    Name string
+    Arg  string
+    // "file:line" positions of the section lines
+    Origin []string
+    // option -> value
+    Data map[string]*string
+    // option -> "file:line" positions where the value was read from
+    Origins map[string][]string
+}
+
+// LineKind tells what a config file line contains.
+type LineKind int
+
+const (
+    // Blank or comment line
+    OTHER_LINE LineKind = iota
+    // Section line "[name arg]"
+    SECTION_LINE
+    // First line of an option value
+    OPTION_LINE
+    // Continuation or comment line inside a continued option value
+    CONTINUATION_LINE
+)
+
+// Line is a line of a config file as it was read.
+type Line struct {
+    Kind LineKind
+    // Line number in the file
+    Number int
+    // Text of the line without the line break
+    Text string
+    // Section the line belongs to, nil before the first section line
+    Section *Section
+    // Option name and the whole value as read, for OPTION_LINEs
+    Option string
+    Value  string
 }
 
 const (
-    COMMENT = '#'
-    OPTION  = "="
+    COMMENT       = '#'
+    OPTION        = "="
+    SECTION_START = '['
+    SECTION_END   = ']'
 )
 
-func Read(file string) (*Config, error) { // {{{
+// ParseError is returned by Read when the config file could not be parsed.
+type ParseError struct {
+    File string
+    Line int
+    Msg  string
+}
+
+func (self *ParseError) Error() string { // {{{
+    return fmt.Sprintf("%s:%d: %s", self.File, self.Line, self.Msg)
+}   // }}}
+
+// Read reads the config file. Option values may continue on the following
+// lines if a line ends with a backslash, or for the list options named in
+// lists, with a comma. A trailing comma in the value of other options is a
+// part of the value. Comment lines are skipped in continued values and an
+// empty line ends the value. Comments starting with a '#' at the beginning of
+// a line or after whitespace are removed, unless the '#' is in double quotes
+// or escaped with a backslash.
+//
+// All lines of the file are kept in Lines, so that the config can be changed
+// and written back with Write without losing comments or option order.
+func Read(file string, lists []string) (*Config, error) { // {{{
     // Initialize Config type
     c := new(Config)
     c.Data = make(map[string]*string)
+    c.Origins = make(map[string][]string)
+    c.Lists = lists
 
     f, err := os.Open(file)
     if err != nil {
         return nil, err
     }
+    defer f.Close()
+
+    // Options are stored to the data of the current section, or to the
+    // config itself before the first section line.
+    data, origins := c.Data, c.Origins
+
+    // Option value which continues on the next line and the line where the
+    // option started
+    var (
+        continued     *string
+        continuedLine *Line
+    )
+
+    // Helper functions to create parse errors and positions for the current
+    // line
+    lineNumber := 0
+    scanner := bufio.NewScanner(f)
+    parseError := func(msg string) error {
+        return &ParseError{file, lineNumber, msg}
+    }
+    position := func() string {
+        return fmt.Sprintf("%s:%d", file, lineNumber)
+    }
+
+    // Helper function to add the current line to the config lines
+    var section *Section
+    addLine := func(kind LineKind) *Line {
+        l := &Line{Kind: kind, Number: lineNumber, Text: scanner.Text(), Section: section}
+        c.Lines = append(c.Lines, l)
+        return l
+    }
 
     // Read the config file and store option values to the created config
-    br := bufio.NewReader(f)
-    for {
-        line, err := br.ReadString('\n')
-        if err != nil {
-            if err == io.EOF {
-                return c, nil
+    for scanner.Scan() {
+        lineNumber++
+        line := strings.TrimSpace(stripComment(scanner.Text()))
+
+        // Append continuation line of a value. Comment lines are skipped and
+        // an empty line ends the value.
+        if continued != nil {
+            if line == "" {
+                if strings.TrimSpace(scanner.Text()) == "" {
+                    continued = nil
+                    addLine(OTHER_LINE)
+                } else {
+                    addLine(CONTINUATION_LINE)
+                }
+                continue
+            }
+            addLine(CONTINUATION_LINE)
+            var more bool
+            line, more = continues(line, c.isList(continuedLine.Option))
+            *continued += "\n" + line
+            continuedLine.Value = *continued
+            if !more {
+                continued = nil
             }
-            return nil, err
+            continue
         }
 
-        line = strings.TrimSpace(line)
-
         // Skip empty and comment lines
-        if line == "" || line[0] == COMMENT {
+        if line == "" {
+            addLine(OTHER_LINE)
+            continue
+        }
+
+        // Parse section line
+        if line[0] == SECTION_START {
+            if line[len(line)-1] != SECTION_END {
+                return nil, parseError("Section line must end with '" + string(SECTION_END) + "'.")
+            }
+            sectionLine := strings.TrimSpace(line[1 : len(line)-1])
+            fields := strings.Fields(sectionLine)
+            if len(fields) < 1 {
+                return nil, parseError("Empty section name.")
+            }
+            section = &Section{
+                Name:    fields[0],
+                Arg:     strings.TrimSpace(sectionLine[len(fields[0]):]),
+                Origin:  []string{position()},
+                Data:    make(map[string]*string),
+                Origins: make(map[string][]string),
+            }
+            c.Sections = append(c.Sections, section)
+            data, origins = section.Data, section.Origins
+            addLine(SECTION_LINE)
             continue
         }
 
         // Parse option line
-        // TODO: maybe allow multiline options
         optionLine := strings.SplitN(line, OPTION, 2)
 
         if len(optionLine) != 2 {
-            return nil, errors.New("Could not parse line: " + line)
+            return nil, parseError("Expected an option line 'NAME " + OPTION + " value': " + line)
         }
 
         optionName := strings.TrimRightFunc(optionLine[0], unicode.IsSpace)
         if optionName == "" {
-            return nil, errors.New("Could not parse line: " + line)
+            return nil, parseError("Empty option name: " + line)
         }
 
-        // TODO: Strip comments
-        optionValue := strings.TrimLeftFunc(optionLine[1], unicode.IsSpace)
+        optionValue, more := continues(strings.TrimLeftFunc(optionLine[1], unicode.IsSpace), c.isList(optionName))
 
         // Add parsed option to the config
-        c.Data[optionName] = &optionValue
+        data[optionName] = &optionValue
+        origins[optionName] = []string{position()}
+        l := addLine(OPTION_LINE)
+        l.Option, l.Value = optionName, optionValue
+        if more {
+            continued, continuedLine = &optionValue, l
+        }
+    }
+    if err := scanner.Err(); err != nil {
+        return nil, err
     }
-
     return c, nil
 }   // }}}
 
+// isList checks whether given option is a list option.
+func (self *Config) isList(option string) bool { // {{{
+    for _, o := range self.Lists {
+        if o == option {
+            return true
+        }
+    }
+    return false
+}   // }}}
+
+// continues checks whether given value continues on the next line, which is
+// the case when it ends with a backslash, or with a list separator if list is
+// true. The possible backslash is removed from the returned value.
+func continues(value string, list bool) (string, bool) { // {{{
+    // Count trailing backslashes, an even number of them are escaped
+    // backslashes.
+    n := len(value) - len(strings.TrimRight(value, string(ESCAPE)))
+    if n%2 == 1 {
+        return strings.TrimRightFunc(value[:len(value)-1], unicode.IsSpace), true
+    }
+    return value, list && continuesList(value)
+}   // }}}
+
+// stripComment removes a comment from given line. A comment starts with a '#'
+// which is at the beginning of the line or after whitespace, and which is not
+// quoted or escaped.
+func stripComment(line string) string { // {{{
+    var quoted, escaped bool
+    prev := ' '
+    for i, r := range line {
+        switch {
+        case escaped:
+            escaped = false
+        case r == ESCAPE:
+            escaped = true
+        case r == QUOTE:
+            quoted = !quoted
+        case !quoted && r == COMMENT && unicode.IsSpace(prev):
+            return line[:i]
+        }
+        prev = r
+    }
+    return line
+}   // }}}
+
 // vim: set sts=4 ts=4 sw=4 et foldmethod=marker:
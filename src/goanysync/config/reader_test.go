@@ -0,0 +1,88 @@
+// Copyright (C) 2012 Esa Määttä <esa.maatta@iki.fi>
+// This file is released under the GNU GPL, version 3 or a later revision.
+// For further details see the COPYING file.
+
+package config
+
+import (
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+func TestReadContinuation(t *testing.T) { // {{{
+    fn := filepath.Join(t.TempDir(), "test.conf")
+    content := "TMPFS = /tmp/a,\nWHATTOSYNC = /a,\n    /b\nLOCKFILE = /run/lock \\\n    x\n"
+    if err := os.WriteFile(fn, []byte(content), 0644); err != nil {
+        t.Fatal(err)
+    }
+    c, err := Read(fn, []string{"WHATTOSYNC"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    want := map[string]string{
+        "TMPFS":      "/tmp/a,",
+        "WHATTOSYNC": "/a,\n/b",
+        "LOCKFILE":   "/run/lock\nx",
+    }
+    for option, value := range want {
+        if v, ok := c.Data[option]; !ok {
+            t.Errorf("Read: %s not read", option)
+        } else if *v != value {
+            t.Errorf("Read: %s = %q, want %q", option, *v, value)
+        }
+    }
+}   // }}}
+
+func TestContinues(t *testing.T) { // {{{
+    tests := []struct {
+        value string
+        list  bool
+        want  string
+        more  bool
+    }{
+        {`/a`, true, `/a`, false},
+        {`/a \`, true, `/a`, true},
+        {`/a\`, false, `/a`, true},
+        {`/a\\`, true, `/a\\`, false},
+        {`/a\\\`, false, `/a\\`, true},
+        {`/a,`, true, `/a,`, true},
+        {`/a,`, false, `/a,`, false},
+        {`/a, \`, false, `/a,`, true},
+        {`/a\,`, true, `/a\,`, false},
+        {`"/a,"`, true, `"/a,"`, false},
+    }
+    for _, test := range tests {
+        got, more := continues(test.value, test.list)
+        if got != test.want || more != test.more {
+            t.Errorf("continues(%q, %t) = %q, %t, want %q, %t", test.value, test.list, got, more, test.want, test.more)
+        }
+    }
+}   // }}}
+
+func TestStripComment(t *testing.T) { // {{{
+    tests := []struct {
+        line string
+        want string
+    }{
+        {``, ``},
+        {`# comment`, ``},
+        {`  # comment`, `  `},
+        {`A = /a`, `A = /a`},
+        {`A = /a # comment`, `A = /a `},
+        {"A = /a\t# comment", "A = /a\t"},
+        {`A = /a#b`, `A = /a#b`},
+        {`A = /a \# b`, `A = /a \# b`},
+        {`A = "/a # b"`, `A = "/a # b"`},
+        {`A = "/a # b" # comment`, `A = "/a # b" `},
+        {`A = "/a \" # b"`, `A = "/a \" # b"`},
+        {`A = /a \\ # comment`, `A = /a \\ `},
+    }
+    for _, test := range tests {
+        if got := stripComment(test.line); got != test.want {
+            t.Errorf("stripComment(%q) = %q, want %q", test.line, got, test.want)
+        }
+    }
+}   // }}}
+
+// vim: set sts=4 ts=4 sw=4 et foldmethod=marker:
@@ -6,26 +6,282 @@ package config
 
 import (
     "bufio"
-    "fmt"
+    "errors"
     "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "syscall"
 )
 
-// Write writes Config struct to the given file.
+// AddSection adds a new empty section to the end of the config.
+func (self *Config) AddSection(name, arg string) *Section { // {{{
+    section := &Section{Name: name, Arg: arg, Data: make(map[string]*string), Origins: make(map[string][]string)}
+    self.Sections = append(self.Sections, section)
+    return section
+}   // }}}
+
+// RemoveSection removes given section from the config.
+func (self *Config) RemoveSection(section *Section) { // {{{
+    for i, s := range self.Sections {
+        if s == section {
+            self.Sections = append(self.Sections[:i], self.Sections[i+1:]...)
+            return
+        }
+    }
+}   // }}}
+
+// Write writes Config struct to the given file. Lines read from the file are
+// written back as they were, except for the options whose values have been
+// changed or removed in Data, or whose sections have been removed from
+// Sections. Blank lines doubled by the removed lines are dropped. New options
+// are written after the last option of their section and new sections at the
+// end of the file.
+//
+// The file is replaced atomically by writing a temporary file in the same
+// directory and renaming it over the file.
 func Write(c *Config, fn string) error { // {{{
-    f, err := os.Create(fn)
+    // Replace the target of a symlink instead of the symlink itself
+    if target, err := filepath.EvalSymlinks(fn); err == nil {
+        fn = target
+    }
+
+    f, err := os.CreateTemp(filepath.Dir(fn), "."+filepath.Base(fn)+".tmp")
     if err != nil {
         return err
     }
+    tmp := f.Name()
+
+    // Keep the permissions and the owner of an existing file
+    if fi, serr := os.Stat(fn); serr == nil {
+        err = f.Chmod(fi.Mode().Perm())
+        st, ok := fi.Sys().(*syscall.Stat_t)
+        if err == nil && ok && (int(st.Uid) != os.Geteuid() || int(st.Gid) != os.Getegid()) {
+            err = f.Chown(int(st.Uid), int(st.Gid))
+        }
+    } else {
+        err = f.Chmod(0644)
+    }
+
+    if err == nil {
+        bw := bufio.NewWriter(f)
+        for _, line := range render(c) {
+            if _, err = bw.WriteString(line + "\n"); err != nil {
+                break
+            }
+        }
+        if err == nil {
+            err = bw.Flush()
+        }
+    }
+    if err == nil {
+        err = f.Sync()
+    }
+    if cerr := f.Close(); err == nil {
+        err = cerr
+    }
+    if err == nil {
+        err = os.Rename(tmp, fn)
+    }
+    if err != nil {
+        os.Remove(tmp)
+    }
+    return err
+}   // }}}
+
+// render returns the lines of given config.
+func render(c *Config) []string { // {{{
+    var out []string
+
+    // Sections still in the config
+    sections := make(map[*Section]bool)
+    for _, s := range c.Sections {
+        sections[s] = true
+    }
+
+    // The current section, its data, the options of it already written, the
+    // index in out after its section line and the index after its last
+    // option line, where its new options are written. Lines of removed
+    // sections are skipped.
+    var (
+        section   *Section
+        data      = c.Data
+        written   = make(map[string]bool)
+        headerEnd = 0
+        insertAt  = -1
+        skip      = false
+    )
+    rendered := make(map[*Section]bool)
+
+    // Helper function to write options of the current section which were not
+    // in the file
+    endSection := func() {
+        if skip {
+            return
+        }
+        if insertAt < 0 && section != nil {
+            insertAt = headerEnd
+        } else if insertAt < 0 {
+            // No options before the first section, write new options after
+            // the last non-blank line
+            insertAt = len(out)
+            for insertAt > 0 && strings.TrimSpace(out[insertAt-1]) == "" {
+                insertAt--
+            }
+        }
+        var lines []string
+        for _, option := range SortedOptions(data) {
+            if !written[option] {
+                lines = append(lines, formatOption(option, *data[option], c.isList(option))...)
+            }
+        }
+        out = append(out[:insertAt], append(lines, out[insertAt:]...)...)
+    }
+
+    // Continuation lines of the previous option are dropped if the option
+    // was changed or removed
+    dropContinuation := false
+    // Whether lines were dropped after the last written non-blank line, so
+    // that blank lines around them are not doubled
+    dropped := false
+    for _, l := range c.Lines {
+        switch l.Kind {
+        case SECTION_LINE:
+            endSection()
+            section, data, written, insertAt = l.Section, l.Section.Data, make(map[string]bool), -1
+            skip = !sections[section]
+            dropContinuation = false
+            if !skip {
+                rendered[section] = true
+                out = append(out, l.Text)
+                headerEnd = len(out)
+                dropped = false
+            } else {
+                dropped = true
+            }
+            continue
+        case CONTINUATION_LINE:
+            if !skip && !dropContinuation {
+                out = append(out, l.Text)
+                // New options go after the whole value
+                if insertAt >= 0 {
+                    insertAt = len(out)
+                }
+            }
+            continue
+        case OPTION_LINE:
+            dropContinuation = true
+            if skip {
+                continue
+            }
+            value, ok := data[l.Option]
+            if !ok || written[l.Option] {
+                dropped = true
+                continue
+            }
+            written[l.Option] = true
+            if *value == l.Value {
+                out = append(out, l.Text)
+                dropContinuation = false
+            } else {
+                out = append(out, formatOption(l.Option, *value, c.isList(l.Option))...)
+            }
+            insertAt = len(out)
+            dropped = false
+            continue
+        }
+        // Blank and comment lines
+        dropContinuation = false
+        if skip {
+            continue
+        }
+        if strings.TrimSpace(l.Text) != "" {
+            dropped = false
+        } else if dropped && (len(out) == 0 || strings.TrimSpace(out[len(out)-1]) == "") {
+            continue
+        }
+        out = append(out, l.Text)
+    }
+    endSection()
+    if dropped {
+        for len(out) > 0 && strings.TrimSpace(out[len(out)-1]) == "" {
+            out = out[:len(out)-1]
+        }
+    }
 
-    // Write given config struct with one option, value pair per line
-    bw := bufio.NewWriter(f)
-    for option, value := range c.Data {
-        line := fmt.Sprintf("%s %s %s\n", option, OPTION, *value)
-        if _, err := bw.WriteString(line); err != nil {
-            return err
+    // Sections which were not in the file are written at the end
+    for _, s := range c.Sections {
+        if rendered[s] {
+            continue
+        }
+        if len(out) > 0 && strings.TrimSpace(out[len(out)-1]) != "" {
+            out = append(out, "")
+        }
+        header := s.Name
+        if s.Arg != "" {
+            header += " " + s.Arg
+        }
+        out = append(out, string(SECTION_START)+header+string(SECTION_END))
+        for _, option := range SortedOptions(s.Data) {
+            out = append(out, formatOption(option, *s.Data[option], c.isList(option))...)
+        }
+    }
+    return out
+}   // }}}
+
+// formatOption returns the lines of an option. Lines of a multiline value are
+// continued with a backslash unless the option is a list and they end with a
+// list separator.
+func formatOption(option, value string, list bool) []string { // {{{
+    lines := strings.Split(value, "\n")
+    indent := strings.Repeat(" ", len(option)+len(OPTION)+2)
+    for i := range lines {
+        if i < len(lines)-1 {
+            if _, more := continues(lines[i], list); !more {
+                lines[i] += " " + string(ESCAPE)
+            }
+        }
+        if i > 0 {
+            lines[i] = indent + lines[i]
+        }
+    }
+    lines[0] = strings.TrimRight(option+" "+OPTION+" "+lines[0], " ")
+    return lines
+}   // }}}
+
+// CheckValue checks that given value of option is read back as it is after
+// it's written with Write. A value can not be written if it has a comment,
+// surrounding whitespace, an empty line or a line ending with a backslash, or
+// for list options, if it ends with a list separator.
+func (self *Config) CheckValue(option, value string) error { // {{{
+    lines := strings.Split(value, "\n")
+    for i, line := range lines {
+        switch {
+        case strings.TrimSpace(line) != line:
+            return errors.New("Value can not start or end with whitespace.")
+        case line == "" && len(lines) > 1:
+            return errors.New("Value can not contain an empty line.")
+        case stripComment(line) != line:
+            return errors.New("Value can not contain an unquoted '" + string(COMMENT) + "' after whitespace, it starts a comment.")
+        }
+        if _, more := continues(line, false); more {
+            return errors.New("Value can not end with a backslash.")
+        }
+        if i == len(lines)-1 && self.isList(option) && continuesList(line) {
+            return errors.New("List value can not end with a list separator.")
         }
     }
     return nil
 }   // }}}
 
+// SortedOptions returns the options of given data in sorted order.
+func SortedOptions(data map[string]*string) []string { // {{{
+    options := make([]string, 0, len(data))
+    for option := range data {
+        options = append(options, option)
+    }
+    sort.Strings(options)
+    return options
+}   // }}}
+
 // vim: set sts=4 ts=4 sw=4 et foldmethod=marker:
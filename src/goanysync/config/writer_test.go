@@ -0,0 +1,178 @@
+// Copyright (C) 2012 Esa Määttä <esa.maatta@iki.fi>
+// This file is released under the GNU GPL, version 3 or a later revision.
+// For further details see the COPYING file.
+
+package config
+
+import (
+    "os"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+// roundTrip reads config content, edits it with edit, writes it back and
+// returns the written content and the config read from it.
+func roundTrip(t *testing.T, content string, edit func(c *Config)) (string, *Config) { // {{{
+    fn := filepath.Join(t.TempDir(), "test.conf")
+    if err := os.WriteFile(fn, []byte(content), 0644); err != nil {
+        t.Fatal(err)
+    }
+    c, err := Read(fn, []string{"WHATTOSYNC"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    edit(c)
+    if err = Write(c, fn); err != nil {
+        t.Fatal(err)
+    }
+    b, err := os.ReadFile(fn)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if c, err = Read(fn, []string{"WHATTOSYNC"}); err != nil {
+        t.Fatalf("Read of written config: %s\n%s", err, b)
+    }
+    return string(b), c
+}   // }}}
+
+// findSection returns the section with given name and arg.
+func findSection(c *Config, name, arg string) *Section { // {{{
+    for _, s := range c.Sections {
+        if s.Name == name && s.Arg == arg {
+            return s
+        }
+    }
+    return nil
+}   // }}}
+
+// setOption sets option in data to value.
+func setOption(data map[string]*string, option, value string) { // {{{
+    data[option] = &value
+}   // }}}
+
+const testConfig = `# goanysync config
+
+# Where to sync
+TMPFS = /tmp # inline comment
+WHATTOSYNC = /a,
+    # comment inside the list
+    /b
+LOCKFILE = /run/lock \
+    /goanysync
+
+[path /a]
+# Mode of /a
+MODE = overlay   # why overlay
+
+[path /b]
+MODE = bind
+BACKING = archive
+
+# The end
+`
+
+func TestWriteUnchanged(t *testing.T) { // {{{
+    got, c := roundTrip(t, testConfig, func(c *Config) {})
+    if got != testConfig {
+        t.Errorf("Write changed an unchanged config:\n%s\nwant:\n%s", got, testConfig)
+    }
+    want := map[string]string{
+        "TMPFS":      "/tmp",
+        "WHATTOSYNC": "/a,\n/b",
+        "LOCKFILE":   "/run/lock\n/goanysync",
+    }
+    for option, value := range want {
+        if v, ok := c.Data[option]; !ok || *v != value {
+            t.Errorf("Read after Write: %s = %v, want %q", option, v, value)
+        }
+    }
+}   // }}}
+
+func TestWriteEdits(t *testing.T) { // {{{
+    tests := []struct {
+        name string
+        edit func(c *Config)
+        want string
+    }{
+        {"change option in section", func(c *Config) {
+            setOption(findSection(c, "path", "/a").Data, "MODE", "bind")
+        }, strings.Replace(testConfig, "MODE = overlay   # why overlay", "MODE = bind", 1)},
+        {"change option before sections", func(c *Config) {
+            setOption(c.Data, "TMPFS", "/dev/shm")
+        }, strings.Replace(testConfig, "TMPFS = /tmp # inline comment", "TMPFS = /dev/shm", 1)},
+        {"change continued list", func(c *Config) {
+            setOption(c.Data, "WHATTOSYNC", "/a,\n/c")
+        }, strings.Replace(testConfig, "WHATTOSYNC = /a,\n    # comment inside the list\n    /b", "WHATTOSYNC = /a,\n             /c", 1)},
+        {"change continued value", func(c *Config) {
+            setOption(c.Data, "LOCKFILE", "/run/goanysync")
+        }, strings.Replace(testConfig, "LOCKFILE = /run/lock \\\n    /goanysync", "LOCKFILE = /run/goanysync", 1)},
+        {"add option to section", func(c *Config) {
+            setOption(findSection(c, "path", "/a").Data, "BACKING", "archive")
+        }, strings.Replace(testConfig, "MODE = overlay   # why overlay\n", "MODE = overlay   # why overlay\nBACKING = archive\n", 1)},
+        {"add option before sections", func(c *Config) {
+            setOption(c.Data, "VERBOSE", "1")
+        }, strings.Replace(testConfig, "    /goanysync\n", "    /goanysync\nVERBOSE = 1\n", 1)},
+        {"remove option", func(c *Config) {
+            delete(c.Data, "TMPFS")
+        }, strings.Replace(testConfig, "TMPFS = /tmp # inline comment\n", "", 1)},
+        {"remove continued option", func(c *Config) {
+            delete(c.Data, "LOCKFILE")
+        }, strings.Replace(testConfig, "LOCKFILE = /run/lock \\\n    /goanysync\n", "", 1)},
+        {"remove only option of section", func(c *Config) {
+            delete(findSection(c, "path", "/a").Data, "MODE")
+        }, strings.Replace(testConfig, "MODE = overlay   # why overlay\n", "", 1)},
+        {"remove section", func(c *Config) {
+            c.RemoveSection(findSection(c, "path", "/a"))
+        }, strings.Replace(testConfig, "[path /a]\n# Mode of /a\nMODE = overlay   # why overlay\n\n", "", 1)},
+        {"remove last section", func(c *Config) {
+            c.RemoveSection(findSection(c, "path", "/b"))
+        }, strings.Replace(testConfig, "\n[path /b]\nMODE = bind\nBACKING = archive\n\n# The end\n", "", 1)},
+        {"remove first section", func(c *Config) {
+            c.RemoveSection(findSection(c, "path", "/a"))
+            c.RemoveSection(findSection(c, "path", "/b"))
+        }, strings.Replace(testConfig, "\n[path /a]\n# Mode of /a\nMODE = overlay   # why overlay\n\n[path /b]\nMODE = bind\nBACKING = archive\n\n# The end\n", "", 1)},
+        {"add section", func(c *Config) {
+            setOption(c.AddSection("path", "/c").Data, "MODE", "bind")
+        }, testConfig + "\n[path /c]\nMODE = bind\n"},
+    }
+    for _, test := range tests {
+        if got, _ := roundTrip(t, testConfig, test.edit); got != test.want {
+            t.Errorf("%s: Write wrote:\n%s\nwant:\n%s", test.name, got, test.want)
+        }
+    }
+}   // }}}
+
+func TestWriteRemoveBetweenBlankLines(t *testing.T) { // {{{
+    content := "A = 1\n\nB = 2\n\nC = 3\n"
+    want := "A = 1\n\nC = 3\n"
+    got, _ := roundTrip(t, content, func(c *Config) {
+        delete(c.Data, "B")
+    })
+    if got != want {
+        t.Errorf("Write wrote:\n%s\nwant:\n%s", got, want)
+    }
+}   // }}}
+
+func TestRenderNewSections(t *testing.T) { // {{{
+    c := &Config{Data: make(map[string]*string), Origins: make(map[string][]string)}
+    value := "/tmp"
+    c.Data["TMPFS"] = &value
+    c.AddSection("global", "")
+    c.AddSection("path", "/a").Data["MODE"] = &value
+
+    want := []string{
+        "TMPFS = /tmp",
+        "",
+        "[global]",
+        "",
+        "[path /a]",
+        "MODE = /tmp",
+    }
+    if got := render(c); !reflect.DeepEqual(got, want) {
+        t.Errorf("render() = %q, want %q", got, want)
+    }
+}   // }}}
+
+// vim: set sts=4 ts=4 sw=4 et foldmethod=marker:
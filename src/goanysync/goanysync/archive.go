@@ -0,0 +1,264 @@
+// Copyright (C) 2012 Esa Määttä <esa.maatta@iki.fi>
+// This file is released under the GNU GPL, version 3 or a later revision.
+// For further details see the COPYING file.
+
+package main
+
+import (
+    "archive/tar"
+    "compress/gzip"
+    "errors"
+    "io"
+    "os"
+    "path"
+    "path/filepath"
+    "strings"
+    "time"
+)
+
+// writeTarGz writes the contents of directory src to a gzip compressed tar
+// archive dst. Archive entry names are relative to src. The archive is
+// written to a temporary file which is renamed to dst when it's complete, so
+// an interrupted write never leaves a partial archive behind. The temporary
+// file has a unique name, so one left by a crashed write does not prevent
+// later writes.
+func writeTarGz(src string, dst string, cancel <-chan struct{}) (err error) { // {{{
+    f, err := os.CreateTemp(path.Dir(dst), "."+path.Base(dst)+".*.tmp")
+    if err != nil {
+        return
+    }
+    tmp := f.Name()
+    defer func() {
+        if err != nil {
+            os.Remove(tmp)
+        }
+    }()
+
+    zw := gzip.NewWriter(f)
+    tw := tar.NewWriter(zw)
+    err = filepath.Walk(src, func(p string, fi os.FileInfo, werr error) error {
+        if werr != nil {
+            return werr
+        }
+        if interrupted(cancel) {
+            return errInterrupted
+        }
+        rel, err := filepath.Rel(src, p)
+        if err != nil {
+            return err
+        }
+        return writeTarEntry(tw, p, rel, fi)
+    })
+    if err == nil {
+        err = tw.Close()
+    }
+    if err == nil {
+        err = zw.Close()
+    }
+    if err == nil {
+        err = f.Sync()
+    }
+    if cerr := f.Close(); err == nil {
+        err = cerr
+    }
+    if err != nil {
+        return
+    }
+    return os.Rename(tmp, dst)
+}   // }}}
+
+// writeTarEntry writes file p to the tar archive with name rel. Sockets are
+// skipped as they can not be archived.
+func writeTarEntry(tw *tar.Writer, p string, rel string, fi os.FileInfo) error { // {{{
+    if fi.Mode()&os.ModeSocket != 0 {
+        LOG.Debug("Skipping socket: %s", p)
+        return nil
+    }
+
+    var link string
+    if fi.Mode()&os.ModeSymlink != 0 {
+        var err error
+        if link, err = os.Readlink(p); err != nil {
+            return err
+        }
+    }
+    hdr, err := tar.FileInfoHeader(fi, link)
+    if err != nil {
+        return err
+    }
+    hdr.Name = filepath.ToSlash(rel)
+    if fi.IsDir() {
+        hdr.Name += "/"
+    }
+    if err = tw.WriteHeader(hdr); err != nil {
+        return err
+    }
+    if !fi.Mode().IsRegular() {
+        return nil
+    }
+
+    f, err := os.Open(p)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+    _, err = io.Copy(tw, f)
+    return err
+}   // }}}
+
+// extractTarGz extracts a gzip compressed tar archive src to existing
+// directory dst. Owners, permissions and modification times are restored.
+// Entries which would be extracted outside of dst are errors. This includes
+// entries below a symlink, as a symlink extracted earlier from the same archive
+// could otherwise redirect later entries anywhere.
+func extractTarGz(src string, dst string, cancel <-chan struct{}) error { // {{{
+    f, err := os.Open(src)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+    zr, err := gzip.NewReader(f)
+    if err != nil {
+        return err
+    }
+    defer zr.Close()
+
+    // Attributes of dirs are set after their contents are extracted, as
+    // extracting changes their modification times.
+    var dirs []*tar.Header
+
+    tr := tar.NewReader(zr)
+    for {
+        if interrupted(cancel) {
+            return errInterrupted
+        }
+        hdr, err := tr.Next()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return err
+        }
+        name := path.Clean(hdr.Name)
+        if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+            return errors.New("Invalid archive entry: " + hdr.Name)
+        }
+        if err = checkNoSymlinks(dst, path.Dir(name)); err != nil {
+            return err
+        }
+        p := filepath.Join(dst, filepath.FromSlash(name))
+
+        switch hdr.Typeflag {
+        case tar.TypeDir:
+            if err = checkNoSymlinks(dst, name); err != nil {
+                return err
+            }
+            if err = os.MkdirAll(p, 0700); err != nil {
+                return err
+            }
+            dirs = append(dirs, hdr)
+            continue
+        case tar.TypeReg:
+            if err = extractFile(tr, p); err != nil {
+                return err
+            }
+        case tar.TypeSymlink:
+            os.Remove(p)
+            if err = os.Symlink(hdr.Linkname, p); err != nil {
+                return err
+            }
+        case tar.TypeLink:
+            link := path.Clean(hdr.Linkname)
+            if path.IsAbs(link) || link == ".." || strings.HasPrefix(link, "../") {
+                return errors.New("Invalid archive link: " + hdr.Linkname)
+            }
+            if err = checkNoSymlinks(dst, path.Dir(link)); err != nil {
+                return err
+            }
+            os.Remove(p)
+            if err = os.Link(filepath.Join(dst, filepath.FromSlash(link)), p); err != nil {
+                return err
+            }
+            continue
+        default:
+            LOG.Debug("Skipping special archive entry: %s", hdr.Name)
+            continue
+        }
+        if err = setAttributes(p, hdr); err != nil {
+            return err
+        }
+    }
+
+    for i := len(dirs) - 1; i >= 0; i-- {
+        name := path.Clean(dirs[i].Name)
+        // A later entry may have replaced the dir with a symlink.
+        if err := checkNoSymlinks(dst, name); err != nil {
+            return err
+        }
+        p := filepath.Join(dst, filepath.FromSlash(name))
+        if err := setAttributes(p, dirs[i]); err != nil {
+            return err
+        }
+    }
+    return nil
+}   // }}}
+
+// checkNoSymlinks returns an error if any existing component of the slash
+// separated relative path name under dir dst is a symlink. Components which
+// don't exist yet are fine, as nothing below them exists either.
+func checkNoSymlinks(dst string, name string) error { // {{{
+    if name == "." {
+        return nil
+    }
+    p := dst
+    for _, c := range strings.Split(name, "/") {
+        p = filepath.Join(p, c)
+        fi, err := os.Lstat(p)
+        if os.IsNotExist(err) {
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+        if fi.Mode()&os.ModeSymlink != 0 {
+            return errors.New("Invalid archive path through a symlink: " + name)
+        }
+    }
+    return nil
+}   // }}}
+
+// extractFile writes the contents of the current tar entry to file p.
+func extractFile(r io.Reader, p string) error { // {{{
+    os.Remove(p)
+    f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+    if err != nil {
+        return err
+    }
+    if _, err = io.Copy(f, r); err != nil {
+        f.Close()
+        return err
+    }
+    return f.Close()
+}   // }}}
+
+// setAttributes sets the owner, permissions and times of extracted file p
+// from its tar header. Failing to change the owner is an error only for root.
+func setAttributes(p string, hdr *tar.Header) error { // {{{
+    if err := os.Lchown(p, hdr.Uid, hdr.Gid); err != nil && os.Geteuid() == 0 {
+        return err
+    }
+    if hdr.Typeflag == tar.TypeSymlink {
+        return nil
+    }
+    // Chmod after chown as chown may clear the setuid and setgid bits.
+    if err := os.Chmod(p, hdr.FileInfo().Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+        return err
+    }
+    atime := hdr.AccessTime
+    if atime.IsZero() {
+        atime = time.Now()
+    }
+    return os.Chtimes(p, atime, hdr.ModTime)
+}   // }}}
+
+// vim: set sts=4 ts=4 sw=4 et foldmethod=marker:
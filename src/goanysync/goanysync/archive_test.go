@@ -0,0 +1,152 @@
+// Copyright (C) 2012 Esa Määttä <esa.maatta@iki.fi>
+// This file is released under the GNU GPL, version 3 or a later revision.
+// For further details see the COPYING file.
+
+package main
+
+import (
+    "archive/tar"
+    "compress/gzip"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+// writeTestArchive writes a gzip compressed tar archive with entries hdrs to
+// file p. Regular file entries get contents "x".
+func writeTestArchive(t *testing.T, p string, hdrs []*tar.Header) { // {{{
+    f, err := os.Create(p)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer f.Close()
+    zw := gzip.NewWriter(f)
+    tw := tar.NewWriter(zw)
+    for _, hdr := range hdrs {
+        if hdr.Typeflag == tar.TypeReg {
+            hdr.Size = 1
+        }
+        if hdr.Mode == 0 {
+            hdr.Mode = 0755
+        }
+        if err := tw.WriteHeader(hdr); err != nil {
+            t.Fatal(err)
+        }
+        if hdr.Typeflag == tar.TypeReg {
+            if _, err := tw.Write([]byte("x")); err != nil {
+                t.Fatal(err)
+            }
+        }
+    }
+    if err := tw.Close(); err != nil {
+        t.Fatal(err)
+    }
+    if err := zw.Close(); err != nil {
+        t.Fatal(err)
+    }
+}   // }}}
+
+func TestTarGzRoundTrip(t *testing.T) { // {{{
+    tmp := t.TempDir()
+    src := filepath.Join(tmp, "src")
+    dst := filepath.Join(tmp, "dst")
+    for _, d := range []string{filepath.Join(src, "d"), dst} {
+        if err := os.MkdirAll(d, 0755); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := os.WriteFile(filepath.Join(src, "d", "f"), []byte("data"), 0640); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.Symlink("d/f", filepath.Join(src, "l")); err != nil {
+        t.Fatal(err)
+    }
+
+    archive := filepath.Join(tmp, "a.tar.gz")
+    if err := writeTarGz(src, archive, nil); err != nil {
+        t.Fatal(err)
+    }
+    if err := extractTarGz(archive, dst, nil); err != nil {
+        t.Fatal(err)
+    }
+    if b, err := os.ReadFile(filepath.Join(dst, "l")); err != nil || string(b) != "data" {
+        t.Errorf("extracted l = %q, %v, want %q", b, err, "data")
+    }
+    if fi, err := os.Stat(filepath.Join(dst, "d", "f")); err != nil {
+        t.Error(err)
+    } else if fi.Mode().Perm() != 0640 {
+        t.Errorf("extracted d/f mode = %v, want %v", fi.Mode().Perm(), os.FileMode(0640))
+    }
+}   // }}}
+
+func TestExtractTarGzSymlinkEscape(t *testing.T) { // {{{
+    tests := []struct {
+        name string
+        hdrs []*tar.Header
+    }{
+        {"file below symlink", []*tar.Header{
+            {Name: "a", Typeflag: tar.TypeSymlink, Linkname: "OUTSIDE"},
+            {Name: "a/f", Typeflag: tar.TypeReg},
+        }},
+        {"file below nested symlink", []*tar.Header{
+            {Name: "d/", Typeflag: tar.TypeDir},
+            {Name: "d/a", Typeflag: tar.TypeSymlink, Linkname: "OUTSIDE"},
+            {Name: "d/a/f", Typeflag: tar.TypeReg},
+        }},
+        {"dir through symlink", []*tar.Header{
+            {Name: "a", Typeflag: tar.TypeSymlink, Linkname: "OUTSIDE"},
+            {Name: "a/", Typeflag: tar.TypeDir, Mode: 0777},
+        }},
+        {"dir replaced by symlink", []*tar.Header{
+            {Name: "a/", Typeflag: tar.TypeDir, Mode: 0777},
+            {Name: "a", Typeflag: tar.TypeSymlink, Linkname: "OUTSIDE"},
+        }},
+        {"hard link target below symlink", []*tar.Header{
+            {Name: "a", Typeflag: tar.TypeSymlink, Linkname: "OUTSIDE"},
+            {Name: "h", Typeflag: tar.TypeLink, Linkname: "a/f"},
+        }},
+        {"parent dir entry", []*tar.Header{
+            {Name: "../f", Typeflag: tar.TypeReg},
+        }},
+    }
+    for _, test := range tests {
+        tmp := t.TempDir()
+        outside := filepath.Join(tmp, "outside")
+        dst := filepath.Join(tmp, "dst")
+        for _, d := range []string{outside, dst} {
+            if err := os.Mkdir(d, 0700); err != nil {
+                t.Fatal(err)
+            }
+        }
+        if err := os.WriteFile(filepath.Join(outside, "f"), []byte("secret"), 0600); err != nil {
+            t.Fatal(err)
+        }
+        for _, hdr := range test.hdrs {
+            if hdr.Linkname == "OUTSIDE" {
+                hdr.Linkname = outside
+            }
+        }
+        archive := filepath.Join(tmp, "a.tar.gz")
+        writeTestArchive(t, archive, test.hdrs)
+
+        if err := extractTarGz(archive, dst, nil); err == nil {
+            t.Errorf("%s: extractTarGz succeeded, want an error", test.name)
+        }
+        if b, err := os.ReadFile(filepath.Join(outside, "f")); err != nil || string(b) != "secret" {
+            t.Errorf("%s: outside file = %q, %v, want it unchanged", test.name, b, err)
+        }
+        if fi, err := os.Stat(outside); err != nil {
+            t.Errorf("%s: %s", test.name, err)
+        } else if fi.Mode().Perm() != 0700 {
+            t.Errorf("%s: outside dir mode = %v, want it unchanged", test.name, fi.Mode().Perm())
+        }
+        if _, err := os.Lstat(filepath.Join(tmp, "f")); err == nil {
+            t.Errorf("%s: file written to parent of dst", test.name)
+        }
+        if _, err := os.Lstat(filepath.Join(dst, "h")); err == nil {
+            t.Errorf("%s: hard link to outside file created", test.name)
+        }
+    }
+}   // }}}
+
+// vim: set sts=4 ts=4 sw=4 et foldmethod=marker:
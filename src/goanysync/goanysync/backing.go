@@ -0,0 +1,115 @@
+// Copyright (C) 2012 Esa Määttä <esa.maatta@iki.fi>
+// This file is released under the GNU GPL, version 3 or a later revision.
+// For further details see the COPYING file.
+
+package main
+
+import (
+    "errors"
+    "os"
+    "strings"
+)
+
+// Backing stores of sync paths, i.e. how the persistent copy of a sync path
+// is kept on the disk while the path is synced to tmpfs.
+const (
+    // The sync path is moved to the backup path as a directory tree
+    BACKING_DIR = "dir"
+    // The sync path is kept as a compressed tar archive at the archive path
+    BACKING_ARCHIVE = "archive"
+)
+
+// ARCHIVE_POSTFIX is appended to a sync path to get its archive path.
+const ARCHIVE_POSTFIX = BACKUP_POSTFIX + SNAPSHOT_POSTFIX
+
+// getArchivePath returns the archive path of given sync path.
+func getArchivePath(syncSource string) string { // {{{
+    return syncSource + ARCHIVE_POSTFIX
+}   // }}}
+
+// isArchived checks whether the persistent copy of given sync path is an
+// archive. The state on the disk is checked instead of the config, so that
+// a path is handled right even if BACKING was changed while it was synced.
+func isArchived(syncSource string) bool { // {{{
+    return !exists(getBackupPath(syncSource)) && exists(getArchivePath(syncSource))
+}   // }}}
+
+// readBacking reads BACKING option from given option data. If the option is
+// not in data, given default is returned.
+func readBacking(data map[string]*string, def string) (backing string, err error) { // {{{
+    backing = def
+    if v, ok := data["BACKING"]; ok {
+        switch backing = strings.TrimSpace(*v); backing {
+        case BACKING_DIR, BACKING_ARCHIVE:
+        default:
+            err = errors.New("Invalid BACKING: " + *v)
+        }
+    }
+    return
+}   // }}}
+
+// initArchive replaces sync path s with a symlink to volatilePath. The
+// contents of s are archived to the archive path and the archive is extracted
+// to volatilePath, so that a broken archive is noticed before s is removed.
+func initArchive(s string, volatilePath string, cancel <-chan struct{}) (err error) { // {{{
+    archivePath := getArchivePath(s)
+    backupPath := getBackupPath(s)
+    if exists(backupPath) {
+        return errors.New("Backup path already exists: " + backupPath)
+    }
+
+    if err = writeTarGz(s, archivePath, cancel); err != nil {
+        return
+    }
+    // Restore the original state on errors
+    defer func() {
+        if err != nil {
+            os.Remove(archivePath)
+        }
+    }()
+    if err = extractTarGz(archivePath, volatilePath, cancel); err != nil {
+        return
+    }
+
+    // The original dir is removed only after the symlink is in place
+    if err = os.Rename(s, backupPath); err != nil {
+        return
+    }
+    if err = os.Symlink(volatilePath, s); err != nil {
+        if rerr := os.Rename(backupPath, s); rerr != nil {
+            LOG.Err("initSync (archive): Restoring '%s' -> '%s' failed: %s", backupPath, s, rerr)
+        }
+        return
+    }
+    if rerr := removeAll(backupPath); rerr != nil {
+        LOG.Warn("initSync (archive): Could not remove the original dir: %s", rerr)
+    }
+    return nil
+}   // }}}
+
+// restoreArchive replaces sync path s, which is a symlink to tmpfs, with the
+// directory extracted from its archive, and removes the archive.
+func restoreArchive(s string) error { // {{{
+    archivePath := getArchivePath(s)
+    // The archive is extracted next to s, to the backup path, from where
+    // it's renamed in place.
+    backupPath := getBackupPath(s)
+    if err := os.Mkdir(backupPath, 0700); err != nil {
+        return err
+    }
+    if err := extractTarGz(archivePath, backupPath, nil); err != nil {
+        os.RemoveAll(backupPath)
+        return err
+    }
+    // The symlink may already be gone, e.g. when repaired
+    if err := os.Remove(s); err != nil && !os.IsNotExist(err) {
+        os.RemoveAll(backupPath)
+        return err
+    }
+    if err := os.Rename(backupPath, s); err != nil {
+        return err
+    }
+    return os.Remove(archivePath)
+}   // }}}
+
+// vim: set sts=4 ts=4 sw=4 et foldmethod=marker:
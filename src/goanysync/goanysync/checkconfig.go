@@ -0,0 +1,355 @@
+// Copyright (C) 2012 Esa Määttä <esa.maatta@iki.fi>
+// This file is released under the GNU GPL, version 3 or a later revision.
+// For further details see the COPYING file.
+
+package main
+
+import (
+    "fmt"
+    "goanysync/config"
+    "os"
+    "path"
+    "strings"
+    "time"
+)
+
+// configReport collects the problems found by the checkconfig command.
+type configReport struct {
+    problems []string
+    errors   int
+    warnings int
+}
+
+func (self *configReport) errorf(format string, v ...interface{}) { // {{{
+    self.problems = append(self.problems, "Error: "+fmt.Sprintf(format, v...))
+    self.errors++
+}   // }}}
+
+func (self *configReport) warnf(format string, v ...interface{}) { // {{{
+    self.problems = append(self.problems, "Warning: "+fmt.Sprintf(format, v...))
+    self.warnings++
+}   // }}}
+
+// at returns a "file:line: " prefix telling where an option value was read
+// from, or an empty string if the value has no origin.
+func at(origins []string) string { // {{{
+    if len(origins) == 0 {
+        return ""
+    }
+    return origins[0] + ": "
+}   // }}}
+
+// checkConfig checks the config file and its drop-in files and prints every
+// problem found, instead of stopping at the first one like ReadConfigFile.
+// Returns the exit status of the checkconfig command, which is non-zero if
+// errors were found.
+func checkConfig(cfp string) int { // {{{
+    report := new(configReport)
+    report.check(cfp)
+
+    for _, p := range report.problems {
+        fmt.Println(p)
+    }
+    fmt.Printf("%s: %d error(s), %d warning(s)\n", cfp, report.errors, report.warnings)
+    if report.errors > 0 {
+        return 1
+    }
+    return 0
+}   // }}}
+
+// check reads and checks the config file cfp and its drop-in files.
+func (self *configReport) check(cfp string) { // {{{
+    c, err := config.Read(cfp, listOptions)
+    if err != nil {
+        self.errorf("%s", err)
+        return
+    }
+    self.checkOptions(c)
+
+    pathOrigins := make(map[string]string)
+    recordPathOrigins(c, pathOrigins)
+    includes, err := includeFiles(cfp, c)
+    if err != nil {
+        self.errorf("%s%s", at(c.Origins["INCLUDE_DIR"]), err)
+    }
+    for _, fn := range includes {
+        ic, err := config.Read(fn, listOptions)
+        if err != nil {
+            self.errorf("%s", err)
+            continue
+        }
+        self.checkOptions(ic)
+        recordPathOrigins(ic, pathOrigins)
+        c.Merge(ic, listOptions)
+    }
+
+    self.checkTmpfs(c)
+    self.checkLockfile(c)
+
+    sopts, err := readSyncerOptions(c.Data, syncerOptions{})
+    if err != nil {
+        self.errorf("%s", err)
+    } else if _, err = sopts.newSyncer(); err != nil {
+        self.errorf("%s%s", at(c.Origins["SYNCER"]), err)
+    }
+
+    syncInterval, err := readSyncInterval(c.Data, DEFAULT_SYNC_INTERVAL)
+    if err != nil {
+        self.errorf("%s%s", at(c.Origins["SYNC_INTERVAL"]), err)
+        syncInterval = DEFAULT_SYNC_INTERVAL
+    }
+
+    backing, err := readBacking(c.Data, BACKING_DIR)
+    if err != nil {
+        self.errorf("%s%s", at(c.Origins["BACKING"]), err)
+        backing = BACKING_DIR
+    } else if err = checkBacking(backing, sopts.excludes); err != nil {
+        self.errorf("%s%s", at(c.Origins["BACKING"]), err)
+    }
+
+    mode, err := readMode(c.Data, MODE_SYMLINK)
+    if err != nil {
+        self.errorf("%s%s", at(c.Origins["MODE"]), err)
+        mode = MODE_SYMLINK
+    } else if err = checkMode(mode, backing, sopts.excludes); err != nil {
+        self.errorf("%s%s", at(c.Origins["MODE"]), err)
+    }
+
+    if _, err = readHeadroom(c.Data); err != nil {
+        self.errorf("%s%s", at(c.Origins["TMPFS_HEADROOM"]), err)
+    }
+
+    if _, err = readSnapshotOptions(c.Data); err != nil {
+        self.errorf("%s", err)
+    }
+    if _, err = readGenerations(c.Data); err != nil {
+        self.errorf("%s%s", at(c.Origins["GENERATIONS"]), err)
+    }
+
+    self.checkSyncPaths(c, pathOrigins, sopts, syncInterval, backing, mode)
+}   // }}}
+
+// checkOptions reports unknown options and sections of a single config file.
+func (self *configReport) checkOptions(c *config.Config) { // {{{
+    for _, option := range config.SortedOptions(c.Data) {
+        if !isOption(option, globalOptions) {
+            self.errorf("%sUnknown option: %s", at(c.Origins[option]), option)
+        }
+    }
+    for _, section := range c.Sections {
+        if section.Name != PATH_SECTION {
+            self.errorf("%sUnknown section: %s", at(section.Origin), section.Name)
+            continue
+        }
+        for _, option := range config.SortedOptions(section.Data) {
+            if !isOption(option, pathSectionOptions) {
+                self.errorf("%sUnknown option: %s", at(section.Origins[option]), option)
+            }
+        }
+    }
+}   // }}}
+
+// checkTmpfs checks the TMPFS option, the permissions of its parent dirs and
+// that it's on a tmpfs file system.
+func (self *configReport) checkTmpfs(c *config.Config) { // {{{
+    v, ok := c.Data["TMPFS"]
+    if !ok {
+        self.errorf("No TMPFS defined.")
+        return
+    }
+    pos := at(c.Origins["TMPFS"])
+    tmpfsPath, err := expandPath(strings.TrimSpace(*v))
+    switch {
+    case err != nil:
+        self.errorf("%sTMPFS: %s", pos, err)
+        return
+    case len(tmpfsPath) < 1:
+        self.errorf("%sEmpty TMPFS path defined.", pos)
+        return
+    case !path.IsAbs(tmpfsPath):
+        self.errorf("%sTMPFS path must be absolute.", pos)
+        return
+    }
+
+    for p := path.Dir(tmpfsPath); p != string(os.PathSeparator); p = path.Dir(p) {
+        d, serr := os.Stat(p)
+        if serr != nil {
+            self.errorf("%sThe TMPFS parent path '%s' access error: %s", pos, p, serr)
+            return
+        }
+        if m := d.Mode(); m&0111 != 0111 {
+            self.errorf("%sThe TMPFS parent path '%s' did not have executable bit set for all users.", pos, p)
+        }
+    }
+
+    // A file system which is not RAM-backed is an error or a warning as
+    // configured.
+    topts, err := readTmpfsCheckOptions(c.Data)
+    if err != nil {
+        self.errorf("%s%s", at(append(c.Origins["TMPFS_CHECK"], c.Origins["TMPFS_ZRAM"]...)), err)
+        return
+    }
+    if topts.action == TMPFS_CHECK_OFF {
+        return
+    }
+    info, err := getTmpfsInfo(tmpfsPath)
+    if err != nil {
+        self.errorf("%s%s", pos, err)
+        return
+    }
+    if !info.ramBacked(topts.zram) {
+        msg := fmt.Sprintf("%sTMPFS path '%s' is not on a RAM-backed file system but on %s.", pos, tmpfsPath, info.fsType())
+        if topts.action == TMPFS_CHECK_REFUSE {
+            self.errorf("%s", msg)
+        } else {
+            self.warnf("%s", msg)
+        }
+    }
+}   // }}}
+
+// checkLockfile checks the LOCKFILE option and the permissions of the lock
+// file dir.
+func (self *configReport) checkLockfile(c *config.Config) { // {{{
+    v, ok := c.Data["LOCKFILE"]
+    if !ok {
+        self.errorf("No LOCKFILE defined.")
+        return
+    }
+    pos := at(c.Origins["LOCKFILE"])
+    lockfilePath, err := expandPath(strings.TrimSpace(*v))
+    switch {
+    case err != nil:
+        self.errorf("%sLOCKFILE: %s", pos, err)
+        return
+    case len(lockfilePath) < 1:
+        self.errorf("%sEmpty LOCKFILE path defined.", pos)
+        return
+    case !path.IsAbs(lockfilePath):
+        self.errorf("%sLOCKFILE path must be absolute.", pos)
+        return
+    }
+    if err = checkLockFileDir(path.Dir(lockfilePath)); err != nil {
+        self.errorf("%sLock file path: %s", pos, err)
+    }
+}   // }}}
+
+// checkSyncPaths checks WHATTOSYNC paths and path sections. Every path must
+// be an absolute path of an existing directory, glob patterns should match
+// something and no sync path may be inside another one.
+func (self *configReport) checkSyncPaths(c *config.Config, pathOrigins map[string]string, sopts syncerOptions, syncInterval time.Duration, backing string, mode string) { // {{{
+    // Sync paths and the "file:line: " prefixes where they were defined
+    var paths, positions []string
+
+    v, hasWhatToSync := c.Data["WHATTOSYNC"]
+    if !hasWhatToSync && len(c.Sections) == 0 {
+        self.errorf("No WHATTOSYNC defined.")
+    }
+    if hasWhatToSync {
+        entries, err := config.ParseList(*v)
+        if err != nil {
+            self.errorf("%sWHATTOSYNC: %s", at(c.Origins["WHATTOSYNC"]), err)
+        } else if len(entries) < 1 {
+            self.errorf("%sEmpty WHATTOSYNC paths defined.", at(c.Origins["WHATTOSYNC"]))
+        }
+        for _, e := range entries {
+            pos := at(c.Origins["WHATTOSYNC"])
+            if o, ok := pathOrigins[e]; ok {
+                pos = o + ": "
+            }
+            p, err := expandPath(e)
+            if err != nil {
+                self.errorf("%sWHATTOSYNC: %s: %s", pos, e, err)
+                continue
+            }
+            paths, positions = append(paths, p), append(positions, pos)
+        }
+    }
+
+    sectionPaths := make(map[string]bool)
+    for _, section := range c.Sections {
+        if section.Name != PATH_SECTION {
+            continue
+        }
+        pos := at(section.Origin)
+        p, err := expandPath(section.Arg)
+        if err != nil {
+            self.errorf("%s[%s %s]: %s", pos, section.Name, section.Arg, err)
+            continue
+        }
+        if sectionPaths[path.Clean(p)] {
+            self.errorf("%s[%s %s]: Duplicate section.", pos, section.Name, section.Arg)
+            continue
+        }
+        sectionPaths[path.Clean(p)] = true
+
+        known := true
+        for option := range section.Data {
+            known = known && isOption(option, pathSectionOptions)
+        }
+        // Unknown options were already reported
+        if known {
+            if _, err = readPathSection(section, sopts, syncInterval, backing, mode, c.Origins); err != nil {
+                self.errorf("%s[%s %s]: %s", pos, section.Name, section.Arg, err)
+            }
+        }
+
+        found := false
+        for _, v := range paths {
+            found = found || path.Clean(v) == path.Clean(p)
+        }
+        if !found {
+            paths, positions = append(paths, p), append(positions, pos)
+        }
+    }
+
+    // Check the paths and expand glob patterns
+    var dirs, dirPositions []string
+    for i, p := range paths {
+        pos := positions[i]
+        if !path.IsAbs(p) {
+            self.errorf("%sSync path must be absolute: %s", pos, p)
+            continue
+        }
+        if isGlob(p) {
+            matches, err := expandGlob(p)
+            if err != nil {
+                self.errorf("%s%s", pos, err)
+            } else if len(matches) == 0 {
+                self.warnf("%sSync path pattern matches no directories: %s", pos, p)
+            }
+            for _, m := range matches {
+                dirs, dirPositions = append(dirs, path.Clean(m)), append(dirPositions, pos)
+            }
+            continue
+        }
+        if _, _, _, err := isValidSource(p); err != nil {
+            self.errorf("%sInvalid sync path: %s", pos, err)
+            continue
+        }
+        dirs, dirPositions = append(dirs, path.Clean(p)), append(dirPositions, pos)
+    }
+
+    // Check that no sync path is inside another
+    for i, a := range dirs {
+        for j, b := range dirs[i+1:] {
+            switch {
+            case a == b:
+                self.errorf("%sSync path is defined more than once: %s", dirPositions[i+1+j], a)
+            case isInside(b, a):
+                self.errorf("%sSync path '%s' is inside sync path '%s' (%s).", dirPositions[i+1+j], b, a, strings.TrimSuffix(dirPositions[i], ": "))
+            case isInside(a, b):
+                self.errorf("%sSync path '%s' is inside sync path '%s' (%s).", dirPositions[i], a, b, strings.TrimSuffix(dirPositions[i+1+j], ": "))
+            }
+        }
+    }
+}   // }}}
+
+// isInside checks whether cleaned absolute path p is inside dir.
+func isInside(p, dir string) bool { // {{{
+    if dir == "/" {
+        return p != "/"
+    }
+    return strings.HasPrefix(p, dir+"/")
+}   // }}}
+
+// vim: set sts=4 ts=4 sw=4 et foldmethod=marker:
@@ -11,37 +11,376 @@ import (
     "os"
     "os/exec"
     "path"
+    "path/filepath"
     "strings"
+    "time"
 )
 
+// DEFAULT_SYNC_INTERVAL is used by the daemon command when no SYNC_INTERVAL is
+// defined in the config file.
+const DEFAULT_SYNC_INTERVAL = time.Hour
+
+// PATH_SECTION is the name of config file sections which define per path
+// options, e.g. "[path /home/user/.cache]".
+const PATH_SECTION = "path"
+
+// globalOptions lists the options allowed outside of sections.
+var globalOptions = []string{"TMPFS", "SYNCER", "RSYNC_BIN", "SYNCER_ARGS", "EXCLUDE", "WHATTOSYNC", "LOCKFILE", "SYNC_INTERVAL", "INCLUDE_DIR",
+    "SNAPSHOT_DIR", "SNAPSHOT_KEEP", "SNAPSHOT_MAX_AGE", "SNAPSHOT_AFTER_SYNC", "GENERATIONS", "BACKING", "MODE", "TMPFS_HEADROOM",
+    "TMPFS_CHECK", "TMPFS_ZRAM"}
+
+// pathSectionOptions lists the options allowed in path sections.
+var pathSectionOptions = []string{"SYNCER", "RSYNC_BIN", "SYNCER_ARGS", "EXCLUDE", "SYNC_INTERVAL", "WRITEBACK", "BACKING", "MODE", "PRIORITY"}
+
+// listOptions lists the options whose values are appended, instead of
+// replaced, when they are given in multiple config files.
+var listOptions = []string{"WHATTOSYNC", "EXCLUDE"}
+
+// DEFAULT_INCLUDE_DIR is the drop-in config directory used when the main
+// config file has no INCLUDE_DIR option. It's relative to the directory of the
+// main config file.
+const DEFAULT_INCLUDE_DIR = "goanysync.d"
+
+// INCLUDE_PATTERN matches the config files read from the drop-in directory.
+const INCLUDE_PATTERN = "*.conf"
+
 // configOptions to be read from the config file.
 type ConfigOptions struct {
-    tmpfsPath string
-    syncPaths []string
-    syncerBin string
-    lockfile  string
+    tmpfsPath    string
+    syncPaths    []string
+    syncer       Syncer
+    lockfile     string
+    syncInterval time.Duration
+    backing      string
+    mode         string
+    headroom     Headroom
+    tmpfsCheck   TmpfsCheckOptions
+    snapshot     SnapshotOptions
+    // Number of backup generations kept of every sync path
+    generations int
+    // Options of paths which had a path section in the config file
+    pathOptions map[string]*PathOptions
+    // Glob patterns of the path sections in the config file order
+    pathPatterns []string
+    // option -> "file:line" positions where the value was read from
+    origins map[string][]string
+    // sync path -> "file:line" position where the path was defined
+    pathOrigins map[string]string
+    // Whether file system operations are only logged, see setDryRun
+    dryRun bool
+}
+
+// PathOptions are the options of a single sync path. Options not given in the
+// path section of the path are taken from the global options.
+type PathOptions struct {
+    syncer       Syncer
+    excludes     []string
+    syncInterval time.Duration
+    // Whether the content of the path is synced back to the disk
+    writeback bool
+    backing   string
+    mode      string
+    // Paths with higher priority are copied to tmpfs first
+    priority int
+    // option -> "file:line" positions where the value was read from
+    origins map[string][]string
 }
 
+// options returns options of given sync path. Options of a path section with
+// a glob pattern apply to every path matching the pattern. A section of the
+// path itself is used before patterns, and of the matching patterns the one
+// which is first in the config file.
+func (self *ConfigOptions) options(s string) *PathOptions { // {{{
+    if popts, ok := self.pathOptions[s]; ok {
+        return popts
+    }
+    for _, pattern := range self.pathPatterns {
+        if matched, _ := path.Match(pattern, s); matched {
+            return self.pathOptions[pattern]
+        }
+    }
+    return &PathOptions{self.syncer, nil, self.syncInterval, true, self.backing, self.mode, 0, self.origins}
+}   // }}}
+
+// from returns a string telling where an option value was read from.
+func from(origins []string) string { // {{{
+    if len(origins) == 0 {
+        return "(default)"
+    }
+    return "(" + strings.Join(origins, ", ") + ")"
+}   // }}}
+
 func (self *ConfigOptions) Print() {
     const indent string = "  "
     fmt.Println("Config options:")
-    fmt.Println(indent, "TMPFS:", self.tmpfsPath)
-    fmt.Println(indent, "RSYNC_BIN:", self.syncerBin)
+    fmt.Println(indent, "TMPFS:", self.tmpfsPath, from(self.origins["TMPFS"]))
+    fmt.Println(indent, "SYNCER:", self.syncer, from(self.origins["SYNCER"]))
+    fmt.Println(indent, "LOCKFILE:", self.lockfile, from(self.origins["LOCKFILE"]))
+    fmt.Println(indent, "SYNC_INTERVAL:", self.syncInterval, from(self.origins["SYNC_INTERVAL"]))
+    fmt.Println(indent, "BACKING:", self.backing, from(self.origins["BACKING"]))
+    fmt.Println(indent, "MODE:", self.mode, from(self.origins["MODE"]))
+    fmt.Println(indent, "TMPFS_HEADROOM:", self.headroom, from(self.origins["TMPFS_HEADROOM"]))
+    fmt.Println(indent, "TMPFS_CHECK:", self.tmpfsCheck.action, from(self.origins["TMPFS_CHECK"]))
+    fmt.Println(indent, "TMPFS_ZRAM:", self.tmpfsCheck.zram, from(self.origins["TMPFS_ZRAM"]))
+    fmt.Println(indent, "GENERATIONS:", self.generations, from(self.origins["GENERATIONS"]))
+    if self.snapshot.dir != "" {
+        fmt.Println(indent, "SNAPSHOT_DIR:", self.snapshot.dir, from(self.origins["SNAPSHOT_DIR"]))
+        fmt.Println(indent, "SNAPSHOT_KEEP:", self.snapshot.keep, from(self.origins["SNAPSHOT_KEEP"]))
+        fmt.Println(indent, "SNAPSHOT_MAX_AGE:", self.snapshot.maxAge, from(self.origins["SNAPSHOT_MAX_AGE"]))
+        fmt.Println(indent, "SNAPSHOT_AFTER_SYNC:", self.snapshot.afterSync, from(self.origins["SNAPSHOT_AFTER_SYNC"]))
+    }
     fmt.Println(indent, "WHATTOSYNC:")
     for i, v := range self.syncPaths {
-        fmt.Printf("%s%s %d: %s\n", indent, indent, i, v)
+        fmt.Printf("%s%s %d: %s (%s)\n", indent, indent, i, v, self.pathOrigins[v])
+        if _, ok := self.pathOptions[v]; ok {
+            popts := self.options(v)
+            fmt.Printf("%s%s%s SYNCER: %s %s\n", indent, indent, indent, popts.syncer, from(popts.origins["SYNCER"]))
+            if len(popts.excludes) > 0 {
+                fmt.Printf("%s%s%s EXCLUDE: %s %s\n", indent, indent, indent, strings.Join(popts.excludes, ", "), from(popts.origins["EXCLUDE"]))
+            }
+            fmt.Printf("%s%s%s SYNC_INTERVAL: %s %s\n", indent, indent, indent, popts.syncInterval, from(popts.origins["SYNC_INTERVAL"]))
+            fmt.Printf("%s%s%s WRITEBACK: %t %s\n", indent, indent, indent, popts.writeback, from(popts.origins["WRITEBACK"]))
+            fmt.Printf("%s%s%s BACKING: %s %s\n", indent, indent, indent, popts.backing, from(popts.origins["BACKING"]))
+            fmt.Printf("%s%s%s MODE: %s %s\n", indent, indent, indent, popts.mode, from(popts.origins["MODE"]))
+            fmt.Printf("%s%s%s PRIORITY: %d %s\n", indent, indent, indent, popts.priority, from(popts.origins["PRIORITY"]))
+        }
     }
     fmt.Println("")
 }
 
+// syncerOptions are the config options which define a syncer.
+type syncerOptions struct {
+    name     string
+    bin      string
+    args     []string
+    excludes []string
+}
+
+// readSyncerOptions reads SYNCER, RSYNC_BIN, SYNCER_ARGS and EXCLUDE options
+// from given option data. Options not in data are taken from given defaults.
+func readSyncerOptions(data map[string]*string, defaults syncerOptions) (sopts syncerOptions, err error) { // {{{
+    sopts = defaults
+
+    if v, ok := data["RSYNC_BIN"]; ok {
+        sopts.bin = strings.TrimSpace(*v)
+        // If RSYNC_BIN option is defined but with empty value then issue error.
+        if len(sopts.bin) < 1 {
+            err = errors.New("Empty RSYNC_BIN path defined.")
+            return
+        }
+    }
+
+    if v, ok := data["SYNCER"]; ok {
+        sopts.name = strings.TrimSpace(*v)
+        if len(sopts.name) < 1 {
+            err = errors.New("Empty SYNCER defined.")
+            return
+        }
+    } else if sopts.name == "" {
+        // If no SYNCER option is defined default to rsync when it's found and
+        // otherwise to the native syncer.
+        sopts.name = SYNCER_GO
+        rsyncBin := sopts.bin
+        if rsyncBin == "" {
+            rsyncBin = "rsync"
+        }
+        if _, oerr := exec.LookPath(rsyncBin); oerr == nil {
+            sopts.name = SYNCER_RSYNC
+        }
+    }
+
+    if v, ok := data["SYNCER_ARGS"]; ok {
+        sopts.args = strings.Fields(*v)
+    }
+
+    if v, ok := data["EXCLUDE"]; ok {
+        if sopts.excludes, err = config.ParseList(*v); err != nil {
+            err = errors.New("EXCLUDE: " + err.Error())
+            return
+        }
+    }
+    return
+}   // }}}
+
+// newSyncer creates the syncer defined by the options. It checks that the
+// syncer binary is executable and found from PATH if it's relative.
+func (self syncerOptions) newSyncer() (syncer Syncer, err error) { // {{{
+    bin := self.bin
+    if self.name != SYNCER_RSYNC {
+        bin = ""
+    }
+    if syncer, err = newSyncer(self.name, bin, self.args, self.excludes); err != nil {
+        return
+    }
+
+    if bin := syncerCommand(syncer); bin != "" {
+        if _, oerr := exec.LookPath(bin); oerr != nil {
+            fmsg := fmt.Sprintf("Could not find the sync-binary. (%s) - %s", bin, oerr)
+            err = errors.New(fmsg)
+            return
+        }
+    }
+    return
+}   // }}}
+
+// readSyncInterval reads SYNC_INTERVAL option from given option data. If the
+// option is not in data, given default is returned.
+func readSyncInterval(data map[string]*string, def time.Duration) (syncInterval time.Duration, err error) { // {{{
+    syncInterval = def
+    if v, ok := data["SYNC_INTERVAL"]; ok {
+        if syncInterval, err = time.ParseDuration(strings.TrimSpace(*v)); err != nil {
+            err = errors.New("Invalid SYNC_INTERVAL: " + err.Error())
+            return
+        }
+        if syncInterval <= 0 {
+            err = errors.New("SYNC_INTERVAL must be positive.")
+            return
+        }
+    }
+    return
+}   // }}}
+
+// parseBool parses yes/no style boolean option value.
+func parseBool(v string) (bool, error) { // {{{
+    switch strings.ToLower(strings.TrimSpace(v)) {
+    case "yes", "true", "on", "1":
+        return true, nil
+    case "no", "false", "off", "0":
+        return false, nil
+    }
+    return false, errors.New("Invalid boolean value: " + v)
+}   // }}}
+
+// readPathSection reads options of a path section. Options not in the section
+// are taken from given global syncer options, sync interval, backing and mode,
+// and their origins from given global origins.
+func readPathSection(section *config.Section, gsopts syncerOptions, gsyncInterval time.Duration, gbacking string, gmode string, gorigins map[string][]string) (popts *PathOptions, err error) { // {{{
+    for option := range section.Data {
+        if !isOption(option, pathSectionOptions) {
+            err = errors.New("Unknown option: " + option)
+            return
+        }
+    }
+
+    popts = &PathOptions{writeback: true, origins: make(map[string][]string)}
+
+    // Options not in the section have the origins of the global options
+    for option, origins := range gorigins {
+        popts.origins[option] = origins
+    }
+    for option, origins := range section.Origins {
+        popts.origins[option] = origins
+    }
+
+    var sopts syncerOptions
+    if sopts, err = readSyncerOptions(section.Data, gsopts); err != nil {
+        return
+    }
+    if popts.syncer, err = sopts.newSyncer(); err != nil {
+        return
+    }
+    popts.excludes = sopts.excludes
+
+    if popts.syncInterval, err = readSyncInterval(section.Data, gsyncInterval); err != nil {
+        return
+    }
+
+    if v, ok := section.Data["WRITEBACK"]; ok {
+        if popts.writeback, err = parseBool(*v); err != nil {
+            err = errors.New("WRITEBACK: " + err.Error())
+            return
+        }
+    }
+
+    if popts.backing, err = readBacking(section.Data, gbacking); err != nil {
+        return
+    }
+    if err = checkBacking(popts.backing, popts.excludes); err != nil {
+        return
+    }
+
+    if popts.mode, err = readMode(section.Data, gmode); err != nil {
+        return
+    }
+    if err = checkMode(popts.mode, popts.backing, popts.excludes); err != nil {
+        return
+    }
+
+    if popts.priority, err = readPriority(section.Data); err != nil {
+        return
+    }
+    return
+}   // }}}
+
+// checkBacking checks that given backing store supports the other options.
+func checkBacking(backing string, excludes []string) error { // {{{
+    // Excluded files would not be in the archive and would be lost when the
+    // path is restored from it.
+    if backing == BACKING_ARCHIVE && len(excludes) > 0 {
+        return errors.New("EXCLUDE is not supported with archive BACKING.")
+    }
+    return nil
+}   // }}}
+
+// checkMode checks that given mode supports given backing store and
+// excludes.
+func checkMode(mode string, backing string, excludes []string) error { // {{{
+    // With archive backing there is no disk copy to mount for syncing.
+    if mode == MODE_BIND && backing == BACKING_ARCHIVE {
+        return errors.New("Bind MODE is not supported with archive BACKING.")
+    }
+    if mode == MODE_OVERLAY && backing == BACKING_ARCHIVE {
+        return errors.New("Overlay MODE is not supported with archive BACKING.")
+    }
+    // Nothing is copied to an overlay, and every modified file is merged back.
+    if mode == MODE_OVERLAY && len(excludes) > 0 {
+        return errors.New("EXCLUDE is not supported with overlay MODE.")
+    }
+    return nil
+}   // }}}
+
+// isOption checks whether given option is in given list of options.
+func isOption(option string, options []string) bool { // {{{
+    for _, o := range options {
+        if o == option {
+            return true
+        }
+    }
+    return false
+}   // }}}
+
 // readConfigFile reads config file and checks that necessary information was
 // given. After this it returns the read options in configOptions struct.
 func ReadConfigFile(cfp string) (copts *ConfigOptions, err error) {
     var c *config.Config
-    c, err = config.Read(cfp)
+    c, err = config.Read(cfp, listOptions)
     if err != nil {
         return
     }
+    return readConfig(cfp, c)
+}
+
+// readConfig reads the options from the already read main config file c of
+// path cfp and from its drop-in config files, which are merged to c.
+func readConfig(cfp string, c *config.Config) (copts *ConfigOptions, err error) { // {{{
+    // ---------------------------------------
+    // Read the drop-in config files from the INCLUDE_DIR directory in
+    // lexical order. Values of list options are appended and other values
+    // later in the order replace the earlier ones.
+    pathOrigins := make(map[string]string)
+    recordPathOrigins(c, pathOrigins)
+    var includes []string
+    if includes, err = includeFiles(cfp, c); err != nil {
+        return
+    }
+    for _, fn := range includes {
+        var ic *config.Config
+        if ic, err = config.Read(fn, listOptions); err != nil {
+            return
+        }
+        recordPathOrigins(ic, pathOrigins)
+        c.Merge(ic, listOptions)
+    }
 
     // ---------------------------------------
     // Read the config files TMPFS option
@@ -56,6 +395,11 @@ func ReadConfigFile(cfp string) (copts *ConfigOptions, err error) {
         return
     }
 
+    if tmpfsPath, err = expandPath(tmpfsPath); err != nil {
+        err = errors.New("TMPFS: " + err.Error())
+        return
+    }
+
     if !path.IsAbs(tmpfsPath) {
         err = errors.New("TMPFS path must be absolute.")
         return
@@ -79,37 +423,32 @@ func ReadConfigFile(cfp string) (copts *ConfigOptions, err error) {
     }
 
     // ---------------------------------------
-    // Read the config files RSYNC_BIN option.
-    // If no RSYNC_BIN option is defined in the config file default to "rsync".
-    var syncerBin string = "rsync"
-    if _, ok := c.Data["RSYNC_BIN"]; ok {
-        syncerBin = *c.Data["RSYNC_BIN"]
-    }
-    syncerBin = strings.TrimSpace(syncerBin)
-    // If RSYNC_BIN option is defined but with empty value then issue error.
-    if len(syncerBin) < 1 {
-        err = errors.New("Empty RSYNC_BIN path defined.")
+    // Read the config files SYNCER, RSYNC_BIN, SYNCER_ARGS and EXCLUDE
+    // options.
+    var sopts syncerOptions
+    if sopts, err = readSyncerOptions(c.Data, syncerOptions{}); err != nil {
         return
     }
-
-    // Check that syncerBin is executable and found from PATH if it's relative.
-    if _, oerr := exec.LookPath(syncerBin); oerr != nil {
-        fmsg := fmt.Sprintf("Could not find the sync-binary. (%s) - %s", syncerBin, oerr)
-        err = errors.New(fmsg)
+    var syncer Syncer
+    if syncer, err = sopts.newSyncer(); err != nil {
         return
     }
 
     // ---------------------------------------
-    // Read the config files WHATTOSYNC option
-    if _, ok := c.Data["WHATTOSYNC"]; !ok {
+    // Read the config files WHATTOSYNC option. It may be left out if paths
+    // are defined with path sections.
+    _, hasWhatToSync := c.Data["WHATTOSYNC"]
+    if !hasWhatToSync && len(c.Sections) == 0 {
         err = errors.New("No WHATTOSYNC defined.")
         return
     }
-    syncPaths := strings.TrimSpace(*c.Data["WHATTOSYNC"])
-
-    if len(syncPaths) < 1 {
-        err = errors.New("Empty WHATTOSYNC paths defined.")
-        return
+    var syncPaths string
+    if hasWhatToSync {
+        syncPaths = strings.TrimSpace(*c.Data["WHATTOSYNC"])
+        if len(syncPaths) < 1 {
+            err = errors.New("Empty WHATTOSYNC paths defined.")
+            return
+        }
     }
 
     // ---------------------------------------
@@ -125,27 +464,186 @@ func ReadConfigFile(cfp string) (copts *ConfigOptions, err error) {
         return
     }
 
+    if lockfilePath, err = expandPath(lockfilePath); err != nil {
+        err = errors.New("LOCKFILE: " + err.Error())
+        return
+    }
+
     if !path.IsAbs(lockfilePath) {
         err = errors.New("lockfilePath path must be absolute.")
         return
     }
 
+    // ---------------------------------------
+    // Read the config files SYNC_INTERVAL option, used only in daemon mode.
+    var syncInterval time.Duration
+    if syncInterval, err = readSyncInterval(c.Data, DEFAULT_SYNC_INTERVAL); err != nil {
+        return
+    }
+
+    // ---------------------------------------
+    // Read the config files BACKING option
+    var backing string
+    if backing, err = readBacking(c.Data, BACKING_DIR); err != nil {
+        return
+    }
+    if err = checkBacking(backing, sopts.excludes); err != nil {
+        return
+    }
+
+    // ---------------------------------------
+    // Read the config files MODE option
+    var mode string
+    if mode, err = readMode(c.Data, MODE_SYMLINK); err != nil {
+        return
+    }
+    if err = checkMode(mode, backing, sopts.excludes); err != nil {
+        return
+    }
+
+    // ---------------------------------------
+    // Read the config files TMPFS_HEADROOM option
+    var headroom Headroom
+    if headroom, err = readHeadroom(c.Data); err != nil {
+        return
+    }
+
+    // ---------------------------------------
+    // Read the config files TMPFS_CHECK and TMPFS_ZRAM options
+    var tmpfsCheck TmpfsCheckOptions
+    if tmpfsCheck, err = readTmpfsCheckOptions(c.Data); err != nil {
+        return
+    }
+
+    // ---------------------------------------
+    // Read the config files snapshot options
+    var snapshotOptions SnapshotOptions
+    if snapshotOptions, err = readSnapshotOptions(c.Data); err != nil {
+        return
+    }
+
+    var generations int
+    if generations, err = readGenerations(c.Data); err != nil {
+        return
+    }
+
     // Parse WHATTOSYNC comma separated list of paths
-    // XXX: if path names contain commas then though luck for now
-    fieldFunc := func(r rune) bool {
-        return r == ','
+    var paths []string
+    if paths, err = config.ParseList(syncPaths); err != nil {
+        err = errors.New("WHATTOSYNC: " + err.Error())
+        return
     }
-    paths := strings.FieldsFunc(syncPaths, fieldFunc)
-    if len(paths) < 1 {
+    if hasWhatToSync && len(paths) < 1 {
         err = errors.New("Empty WHATTOSYNC paths defined.")
         return
     }
     for i, v := range paths {
-        paths[i] = strings.TrimSpace(v)
+        if paths[i], err = expandPath(v); err != nil {
+            err = fmt.Errorf("WHATTOSYNC: %s: %s", v, err)
+            return
+        }
+        pathOrigins[paths[i]] = pathOrigins[v]
     }
 
-    copts = &ConfigOptions{tmpfsPath, paths, syncerBin, lockfilePath}
+    // ---------------------------------------
+    // Read path sections. Paths which are not in WHATTOSYNC are added to it.
+    pathOptions := make(map[string]*PathOptions)
+    var pathPatterns []string
+    for _, section := range c.Sections {
+        if section.Name != PATH_SECTION {
+            err = errors.New("Unknown section: " + section.Name)
+            return
+        }
+        var p string
+        if p, err = expandPath(section.Arg); err != nil {
+            err = fmt.Errorf("[%s %s]: %s", section.Name, section.Arg, err)
+            return
+        }
+        if len(p) < 1 || !path.IsAbs(p) {
+            err = fmt.Errorf("[%s %s]: Section path must be absolute.", section.Name, section.Arg)
+            return
+        }
+        p = path.Clean(p)
+        if _, ok := pathOptions[p]; ok {
+            err = fmt.Errorf("[%s %s]: Duplicate section.", section.Name, section.Arg)
+            return
+        }
+        var popts *PathOptions
+        if popts, err = readPathSection(section, sopts, syncInterval, backing, mode, c.Origins); err != nil {
+            err = fmt.Errorf("[%s %s]: %s", section.Name, section.Arg, err)
+            return
+        }
+        pathOptions[p] = popts
+        if isGlob(p) {
+            pathPatterns = append(pathPatterns, p)
+        }
+
+        found := false
+        for i, v := range paths {
+            if path.Clean(v) == p {
+                // Use the cleaned path so that options are found with it
+                paths[i] = p
+                pathOrigins[p] = pathOrigins[v]
+                found = true
+            }
+        }
+        if !found {
+            paths = append(paths, p)
+            pathOrigins[p] = strings.Join(section.Origin, ", ")
+        }
+    }
+
+    copts = &ConfigOptions{tmpfsPath, paths, syncer, lockfilePath, syncInterval, backing, mode, headroom, tmpfsCheck, snapshotOptions, generations, pathOptions, pathPatterns, c.Origins, pathOrigins, false}
     return
-}
+}   // }}}
+
+// includeFiles returns the drop-in config files in lexical order. The
+// directory is given by the INCLUDE_DIR option of the main config file c, or
+// is DEFAULT_INCLUDE_DIR if the option is not given. A missing default
+// directory is not an error.
+func includeFiles(cfp string, c *config.Config) (files []string, err error) { // {{{
+    dir := DEFAULT_INCLUDE_DIR
+    v, explicit := c.Data["INCLUDE_DIR"]
+    if explicit {
+        if dir = strings.TrimSpace(*v); len(dir) < 1 {
+            err = errors.New("Empty INCLUDE_DIR path defined.")
+            return
+        }
+        if dir, err = expandPath(dir); err != nil {
+            err = errors.New("INCLUDE_DIR: " + err.Error())
+            return
+        }
+    }
+    if !path.IsAbs(dir) {
+        dir = path.Join(path.Dir(cfp), dir)
+    }
+
+    if fi, serr := os.Stat(dir); serr != nil {
+        if explicit || !os.IsNotExist(serr) {
+            err = fmt.Errorf("INCLUDE_DIR: %s", serr)
+        }
+        return
+    } else if !fi.IsDir() {
+        err = errors.New("INCLUDE_DIR was not a directory: " + dir)
+        return
+    }
+    return filepath.Glob(path.Join(dir, INCLUDE_PATTERN))
+}   // }}}
+
+// recordPathOrigins records to pathOrigins the position of the WHATTOSYNC
+// option for every path in it. Paths already in pathOrigins are not changed.
+func recordPathOrigins(c *config.Config, pathOrigins map[string]string) { // {{{
+    v, ok := c.Data["WHATTOSYNC"]
+    if !ok {
+        return
+    }
+    // Parse errors are reported when the merged value is parsed
+    paths, _ := config.ParseList(*v)
+    for _, p := range paths {
+        if _, ok := pathOrigins[p]; !ok {
+            pathOrigins[p] = c.Origins["WHATTOSYNC"][0]
+        }
+    }
+}   // }}}
 
 // vim: set sts=4 ts=4 sw=4 et foldmethod=marker:
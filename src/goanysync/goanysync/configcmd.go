@@ -0,0 +1,316 @@
+// Copyright (C) 2012 Esa Määttä <esa.maatta@iki.fi>
+// This file is released under the GNU GPL, version 3 or a later revision.
+// For further details see the COPYING file.
+
+package main
+
+import (
+    "errors"
+    "flag"
+    "fmt"
+    "goanysync/config"
+    "os"
+    "path"
+    "strings"
+    "time"
+)
+
+// configCommand runs the config subcommand given in args, which reads or
+// changes the main config file cfp:
+//
+// "get OPTION" prints the value of an option, with drop-in config files
+// applied. List options are printed one entry per line. "set OPTION VALUE"
+// sets the value of an option. "add-path PATH" and "remove-path [--unsync]
+// PATH" add a path to or remove a path from WHATTOSYNC. Removing a path also
+// removes its path section.
+//
+// Changes are checked with the same rules as ReadConfigFile before the file
+// is written. lockWait is the maximum time to wait for the lock file. Returns
+// the exit status of the command.
+func configCommand(cfp string, args []string, lockWait time.Duration) int { // {{{
+    if len(args) < 1 {
+        LOG.Err("No config subcommand given.")
+        return 1
+    }
+
+    var err error
+    switch cmd, args := args[0], args[1:]; cmd {
+    case "get":
+        if len(args) != 1 {
+            err = errors.New("Usage: config get OPTION")
+            break
+        }
+        err = configGet(cfp, args[0])
+    case "set":
+        if len(args) != 2 {
+            err = errors.New("Usage: config set OPTION VALUE")
+            break
+        }
+        err = configEdit(cfp, func(c *config.Config) error { return configSet(c, args[0], args[1]) })
+    case "add-path":
+        if len(args) != 1 {
+            err = errors.New("Usage: config add-path PATH")
+            break
+        }
+        err = configEdit(cfp, func(c *config.Config) error { return configAddPath(c, args[0]) })
+    case "remove-path":
+        flags := flag.NewFlagSet("remove-path", flag.ContinueOnError)
+        unsyncPath := flags.Bool("unsync", false, "Sync and unsync the path first if it's currently synced.")
+        if err = flags.Parse(args); err != nil {
+            break
+        }
+        if flags.NArg() != 1 {
+            err = errors.New("Usage: config remove-path [--unsync] PATH")
+            break
+        }
+        err = configRemovePath(cfp, flags.Arg(0), *unsyncPath, lockWait)
+    default:
+        err = errors.New("Invalid config subcommand: " + cmd)
+    }
+
+    if err != nil {
+        LOG.Err("config: %s", err)
+        return 1
+    }
+    return 0
+}   // }}}
+
+// configGet prints the value of given option.
+func configGet(cfp string, option string) error { // {{{
+    c, err := config.Read(cfp, listOptions)
+    if err != nil {
+        return err
+    }
+    includes, err := includeFiles(cfp, c)
+    if err != nil {
+        return err
+    }
+    for _, fn := range includes {
+        var ic *config.Config
+        if ic, err = config.Read(fn, listOptions); err != nil {
+            return err
+        }
+        c.Merge(ic, listOptions)
+    }
+
+    v, ok := c.Data[option]
+    if !ok {
+        return errors.New("Option not defined: " + option)
+    }
+    if !isOption(option, listOptions) {
+        fmt.Println(*v)
+        return nil
+    }
+    entries, err := config.ParseList(*v)
+    if err != nil {
+        return fmt.Errorf("%s: %s", option, err)
+    }
+    for _, e := range entries {
+        fmt.Println(e)
+    }
+    return nil
+}   // }}}
+
+// configEdit reads the main config file, changes it with given function and
+// writes it back if the changed config is valid.
+func configEdit(cfp string, edit func(c *config.Config) error) error { // {{{
+    c, err := editedConfig(cfp, edit)
+    if err != nil {
+        return err
+    }
+    return config.Write(c, cfp)
+}   // }}}
+
+// editedConfig reads the main config file, changes it with given function and
+// returns the changed config if it's valid.
+func editedConfig(cfp string, edit func(c *config.Config) error) (*config.Config, error) { // {{{
+    c, err := config.Read(cfp, listOptions)
+    if err != nil {
+        return nil, err
+    }
+    if err = edit(c); err != nil {
+        return nil, err
+    }
+
+    // Check a copy, as drop-in config files are merged to the checked config
+    vc := &config.Config{Data: make(map[string]*string), Origins: make(map[string][]string)}
+    vc.Merge(c, nil)
+    if _, err = readConfig(cfp, vc); err != nil {
+        return nil, fmt.Errorf("Changed config is not valid, %s not written: %s", cfp, err)
+    }
+    return c, nil
+}   // }}}
+
+// configSet sets the value of an option. Values which would not be read back
+// as they were set are errors.
+func configSet(c *config.Config, option string, value string) error { // {{{
+    if !isOption(option, globalOptions) {
+        return errors.New("Unknown option: " + option)
+    }
+    if strings.Contains(value, "\n") {
+        return errors.New("Option value can not contain a newline.")
+    }
+    // The value is written as it is, so it must not be read back differently
+    if err := c.CheckValue(option, value); err != nil {
+        return fmt.Errorf("%s: %s", option, err)
+    }
+    c.Data[option] = &value
+    return nil
+}   // }}}
+
+// configAddPath adds given path to the WHATTOSYNC list.
+func configAddPath(c *config.Config, p string) error { // {{{
+    if strings.Contains(p, "\n") {
+        return errors.New("Path can not contain a newline.")
+    }
+    entries, err := whatToSync(c)
+    if err != nil {
+        return err
+    }
+    for _, e := range entries {
+        if samePath(e, p) {
+            return errors.New("Path already in WHATTOSYNC: " + p)
+        }
+    }
+    setWhatToSync(c, append(entries, p))
+    return nil
+}   // }}}
+
+// configRemovePath removes given path from the WHATTOSYNC list and its path
+// section. If the path is currently synced it's first synced and unsynced
+// when unsyncPath is true, otherwise it's an error. The lock file is waited
+// for at most lockWait.
+func configRemovePath(cfp string, p string, unsyncPath bool, lockWait time.Duration) error { // {{{
+    copts, err := ReadConfigFile(cfp)
+    if err != nil {
+        return err
+    }
+    intr := NewInterrupt()
+    defer intr.Stop()
+    cancel := intr.Next()
+
+    lock, err := acquireLock(copts.lockfile, lockWait, cancel)
+    if err != nil {
+        return fmt.Errorf("Lock file: %s", err)
+    }
+    defer lock.release()
+
+    // Find the sync paths of the removed path, patterns are expanded as they
+    // were at start.
+    var syncPaths []string
+    for _, s := range copts.syncPaths {
+        if samePath(s, p) {
+            syncPaths = append(syncPaths, s)
+        }
+    }
+    if len(syncPaths) == 0 {
+        return errors.New("Path not in WHATTOSYNC: " + p)
+    }
+    popts := &ConfigOptions{syncPaths: syncPaths, lockfile: copts.lockfile, pathOrigins: copts.pathOrigins}
+    if err = expandSyncPaths(popts, false); err != nil {
+        return err
+    }
+
+    // Change the config before unsyncing, so that nothing is unsynced if the
+    // config can not be changed
+    c, err := editedConfig(cfp, func(c *config.Config) error {
+        entries, err := whatToSync(c)
+        if err != nil {
+            return err
+        }
+        var kept []string
+        for _, e := range entries {
+            if !samePath(e, p) {
+                kept = append(kept, e)
+            }
+        }
+        removed := len(kept) < len(entries)
+        setWhatToSync(c, kept)
+
+        for _, section := range c.Sections {
+            if section.Name == PATH_SECTION && samePath(section.Arg, p) {
+                c.RemoveSection(section)
+                removed = true
+                break
+            }
+        }
+        if !removed {
+            return fmt.Errorf("Path not in %s, it's defined at %s: %s", cfp, copts.pathOrigins[syncPaths[0]], p)
+        }
+        return nil
+    })
+    if err != nil {
+        return err
+    }
+
+    var synced []string
+    for _, s := range popts.syncPaths {
+        if isSynced(s, copts.tmpfsPath) || isBound(s, copts.lockfile) {
+            synced = append(synced, s)
+        }
+    }
+    if len(synced) > 0 {
+        if !unsyncPath {
+            return errors.New("Path is currently synced, use --unsync to sync it back first: " + strings.Join(synced, ", "))
+        }
+        sync(copts, &synced, cancel)
+        unsync(copts, &synced, true, cancel)
+        for _, s := range synced {
+            if isSynced(s, copts.tmpfsPath) || isBound(s, copts.lockfile) {
+                return errors.New("Could not unsync path: " + s)
+            }
+        }
+    }
+    return config.Write(c, cfp)
+}   // }}}
+
+// whatToSync returns the entries of the WHATTOSYNC list of given config.
+func whatToSync(c *config.Config) ([]string, error) { // {{{
+    v, ok := c.Data["WHATTOSYNC"]
+    if !ok {
+        return nil, nil
+    }
+    entries, err := config.ParseList(*v)
+    if err != nil {
+        return nil, errors.New("WHATTOSYNC: " + err.Error())
+    }
+    return entries, nil
+}   // }}}
+
+// setWhatToSync sets the WHATTOSYNC list of given config. A list which was
+// written one entry per line stays so. An empty list removes the option.
+func setWhatToSync(c *config.Config, entries []string) { // {{{
+    if len(entries) == 0 {
+        delete(c.Data, "WHATTOSYNC")
+        return
+    }
+    separator := ", "
+    if v, ok := c.Data["WHATTOSYNC"]; ok && strings.Contains(*v, "\n") {
+        separator = ",\n"
+    }
+    quoted := make([]string, len(entries))
+    for i, e := range entries {
+        quoted[i] = config.QuoteListEntry(e)
+    }
+    v := strings.Join(quoted, separator)
+    c.Data["WHATTOSYNC"] = &v
+}   // }}}
+
+// samePath checks whether given config paths are the same, either as written
+// or after expanding variables.
+func samePath(a, b string) bool { // {{{
+    if a == b {
+        return true
+    }
+    ea, aerr := expandPath(a)
+    eb, berr := expandPath(b)
+    return aerr == nil && berr == nil && path.Clean(ea) == path.Clean(eb)
+}   // }}}
+
+// isSynced checks whether given sync path is a symlink into the TMPFS path.
+func isSynced(s string, tmpfs string) bool { // {{{
+    target, err := os.Readlink(s)
+    return err == nil && strings.HasPrefix(path.Clean(target), path.Clean(tmpfs)+"/")
+}   // }}}
+
+// vim: set sts=4 ts=4 sw=4 et foldmethod=marker:
@@ -0,0 +1,117 @@
+// Copyright (C) 2012 Esa Määttä <esa.maatta@iki.fi>
+// This file is released under the GNU GPL, version 3 or a later revision.
+// For further details see the COPYING file.
+
+package main
+
+import (
+    "goanysync/config"
+    "io"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+// writeTestConfig writes a minimal valid config file to a temporary directory
+// and returns its path.
+func writeTestConfig(t *testing.T) string { // {{{
+    dir := t.TempDir()
+    // Parents of TMPFS must be searchable by all users
+    for _, d := range []string{filepath.Dir(dir), dir} {
+        if err := os.Chmod(d, 0755); err != nil {
+            t.Fatal(err)
+        }
+    }
+    cfp := filepath.Join(dir, "goanysync.conf")
+    content := "TMPFS = " + filepath.Join(dir, "tmpfs") + "\nWHATTOSYNC = " + filepath.Join(dir, "a") + "\nLOCKFILE = " + filepath.Join(dir, "lock") + "\n"
+    if err := os.WriteFile(cfp, []byte(content), 0644); err != nil {
+        t.Fatal(err)
+    }
+    return cfp
+}   // }}}
+
+// captureStdout returns what f prints to stdout.
+func captureStdout(t *testing.T, f func() error) (string, error) { // {{{
+    r, w, err := os.Pipe()
+    if err != nil {
+        t.Fatal(err)
+    }
+    stdout := os.Stdout
+    os.Stdout = w
+    ferr := f()
+    os.Stdout = stdout
+    w.Close()
+    out, err := io.ReadAll(r)
+    r.Close()
+    if err != nil {
+        t.Fatal(err)
+    }
+    return string(out), ferr
+}   // }}}
+
+func TestConfigSetGet(t *testing.T) { // {{{
+    // DIR in values is replaced with the directory of the config file
+    tests := []struct {
+        option string
+        value  string
+        want   string
+    }{
+        {"LOCKFILE", "DIR/lock", "DIR/lock\n"},
+        {"LOCKFILE", "DIR/lock#1", "DIR/lock#1\n"},
+        {"LOCKFILE", `DIR/"a #b"`, "DIR/\"a #b\"\n"},
+        {"LOCKFILE", `DIR/a\\`, "DIR/a\\\\\n"},
+        {"LOCKFILE", `DIR/a, b,c`, "DIR/a, b,c\n"},
+        {"EXCLUDE", `*.tmp, "a #b", c\,d`, "*.tmp\na #b\nc,d\n"},
+    }
+    for _, test := range tests {
+        cfp := writeTestConfig(t)
+        dir := filepath.Dir(cfp)
+        value := strings.Replace(test.value, "DIR", dir, 1)
+        want := strings.Replace(test.want, "DIR", dir, 1)
+        err := configEdit(cfp, func(c *config.Config) error { return configSet(c, test.option, value) })
+        if err != nil {
+            t.Errorf("config set %s %q: %s", test.option, value, err)
+            continue
+        }
+        got, err := captureStdout(t, func() error { return configGet(cfp, test.option) })
+        if err != nil {
+            t.Errorf("config get %s after setting %q: %s", test.option, value, err)
+        } else if got != want {
+            t.Errorf("config get %s after setting %q = %q, want %q", test.option, value, got, want)
+        }
+    }
+}   // }}}
+
+func TestConfigSetInvalid(t *testing.T) { // {{{
+    tests := []struct {
+        option string
+        value  string
+    }{
+        {"LOCKFILE", "/run/lock # comment"},
+        {"LOCKFILE", "/run/lock\t#comment"},
+        {"LOCKFILE", `/run/lock \`},
+        {"LOCKFILE", `/run/lock\`},
+        {"LOCKFILE", " /run/lock"},
+        {"LOCKFILE", "/run/lock "},
+        {"LOCKFILE", "/run/lock\n/b"},
+        {"EXCLUDE", "*.tmp,"},
+        {"UNKNOWN", "x"},
+    }
+    for _, test := range tests {
+        cfp := writeTestConfig(t)
+        before, err := os.ReadFile(cfp)
+        if err != nil {
+            t.Fatal(err)
+        }
+        err = configEdit(cfp, func(c *config.Config) error { return configSet(c, test.option, test.value) })
+        if err == nil {
+            t.Errorf("config set %s %q succeeded, want an error", test.option, test.value)
+        }
+        if after, err := os.ReadFile(cfp); err != nil || string(after) != string(before) {
+            t.Errorf("config set %s %q changed the config file", test.option, test.value)
+        }
+    }
+}   // }}}
+
+// vim: set sts=4 ts=4 sw=4 et foldmethod=marker:
@@ -0,0 +1,83 @@
+// Copyright (C) 2012 Esa Määttä <esa.maatta@iki.fi>
+// This file is released under the GNU GPL, version 3 or a later revision.
+// For further details see the COPYING file.
+
+package main
+
+import (
+    "time"
+)
+
+// withLock calls f while holding the lock file. Returns false if the lock
+// could not be acquired in given wait time or if f returned false.
+func withLock(lockName string, wait time.Duration, cancel <-chan struct{}, f func() bool) bool { // {{{
+    lock, err := acquireLock(lockName, wait, cancel)
+    if err != nil {
+        LOG.Err("Lock file: %s", err)
+        return false
+    }
+    defer lock.release()
+    return f()
+}   // }}}
+
+// daemon runs the start command, then syncs every path on its sync interval
+// until SIGINT or SIGTERM is received, after which the stop command is run. A
+// second signal interrupts the stop command. The lock file is held only while
+// one of the commands is running, and lockWait is the maximum time to wait for
+// it. Returns programs exit value.
+func daemon(copts *ConfigOptions, lockWait time.Duration, intr *Interrupt) int { // {{{
+    cancel := intr.Next()
+    started := withLock(copts.lockfile, lockWait, cancel, func() bool {
+        if err := expandSyncPaths(copts, true); err != nil {
+            LOG.Err("Sync path patterns: %s", err)
+            return false
+        }
+        return start(copts, cancel)
+    })
+    if started {
+        // Paths may have different sync intervals, so tick at the shortest
+        // of them. Other intervals are rounded to a multiple of it.
+        tick := copts.syncInterval
+        lastSync := make(map[string]time.Time)
+        for _, s := range copts.syncPaths {
+            if i := copts.options(s).syncInterval; i < tick {
+                tick = i
+            }
+            lastSync[s] = time.Now()
+        }
+        LOG.Info("daemon: Started, syncing every %s.", tick)
+
+        ticker := time.NewTicker(tick)
+        for !interrupted(cancel) {
+            select {
+            case now := <-ticker.C:
+                due := make([]string, 0, len(copts.syncPaths))
+                for _, s := range copts.syncPaths {
+                    if now.Sub(lastSync[s]) >= copts.options(s).syncInterval-tick/2 {
+                        due = append(due, s)
+                        lastSync[s] = now
+                    }
+                }
+                withLock(copts.lockfile, lockWait, cancel, func() bool {
+                    sync(copts, &due, cancel)
+                    return true
+                })
+            case <-cancel:
+            }
+        }
+        ticker.Stop()
+    } else if !interrupted(cancel) {
+        return 1
+    }
+
+    // Stop also after an interrupted start, so that paths which were already
+    // initialized are restored.
+    LOG.Info("daemon: Stopping.")
+    stopCancel := intr.Next()
+    if ok := withLock(copts.lockfile, lockWait, stopCancel, func() bool { return stop(copts, stopCancel) }); !ok {
+        return 1
+    }
+    return 0
+}   // }}}
+
+// vim: set sts=4 ts=4 sw=4 et foldmethod=marker:
@@ -0,0 +1,124 @@
+// Copyright (C) 2012 Esa Määttä <esa.maatta@iki.fi>
+// This file is released under the GNU GPL, version 3 or a later revision.
+// For further details see the COPYING file.
+
+package main
+
+import (
+    "os"
+)
+
+// setDryRun puts the options in the dry run mode, where commands log the file
+// system operations and syncer commands they would run instead of running
+// them. Checks which only read the file system are still done, so a dry run
+// fails like a real run would.
+func (self *ConfigOptions) setDryRun() { // {{{
+    self.dryRun = true
+    self.syncer = dryRunSyncer{self.syncer}
+    for _, popts := range self.pathOptions {
+        popts.syncer = dryRunSyncer{popts.syncer}
+    }
+}   // }}}
+
+// dry logs given operation in the dry run mode and returns true, in which
+// case the caller skips the operation.
+func (self *ConfigOptions) dry(format string, a ...interface{}) bool { // {{{
+    if self.dryRun {
+        LOG.Info("Dry run: "+format, a...)
+    }
+    return self.dryRun
+}   // }}}
+
+// The methods below do a file system operation, or only log it in the dry run
+// mode. Operations on existing dirs are done as they change nothing.
+
+func (self *ConfigOptions) mkdir(p string, perm os.FileMode) error { // {{{
+    if !exists(p) && self.dry("mkdir -m %o %s", perm, p) {
+        return nil
+    }
+    return os.Mkdir(p, perm)
+}   // }}}
+
+func (self *ConfigOptions) mkdirAll(p string, perm os.FileMode, uid, gid uint) error { // {{{
+    if !exists(p) && self.dry("mkdir -p -m %o %s, owner %d:%d", perm.Perm(), p, uid, gid) {
+        return nil
+    }
+    return mkdirAll(p, perm, uid, gid)
+}   // }}}
+
+func (self *ConfigOptions) chmod(p string, mode os.FileMode) error { // {{{
+    if self.dry("chmod %o %s", mode.Perm(), p) {
+        return nil
+    }
+    return os.Chmod(p, mode)
+}   // }}}
+
+func (self *ConfigOptions) rename(from, to string) error { // {{{
+    if self.dry("mv %s %s", from, to) {
+        return nil
+    }
+    return os.Rename(from, to)
+}   // }}}
+
+func (self *ConfigOptions) symlink(target, link string) error { // {{{
+    if self.dry("ln -s %s %s", target, link) {
+        return nil
+    }
+    return os.Symlink(target, link)
+}   // }}}
+
+func (self *ConfigOptions) remove(p string) error { // {{{
+    if self.dry("rm %s", p) {
+        return nil
+    }
+    return os.Remove(p)
+}   // }}}
+
+func (self *ConfigOptions) removeVolatilePath(volatilePath string, tmpfs string) { // {{{
+    if self.dry("rm -r %s", volatilePath) {
+        return
+    }
+    removeVolatilePath(volatilePath, tmpfs)
+}   // }}}
+
+func (self *ConfigOptions) removeDiskMountPath(s string) { // {{{
+    if self.dry("rm -r %s", getDiskMountPath(self.lockfile, s)) {
+        return
+    }
+    removeDiskMountPath(self.lockfile, s)
+}   // }}}
+
+func (self *ConfigOptions) writeTarGz(dir string, archive string) error { // {{{
+    if self.dry("tar -czf %s -C %s .", archive, dir) {
+        return nil
+    }
+    return writeTarGz(dir, archive, nil)
+}   // }}}
+
+func (self *ConfigOptions) mergeUpper(upper string, lower string) error { // {{{
+    if self.dry("merge overlay upper layer %s to %s", upper, lower) {
+        return nil
+    }
+    return mergeUpper(upper, lower, nil)
+}   // }}}
+
+func (self *ConfigOptions) restoreArchive(s string) error { // {{{
+    if self.dry("tar -xzf %s -C %s && rm %s && mv %s %s && rm %s",
+        getArchivePath(s), getBackupPath(s), s, getBackupPath(s), s, getArchivePath(s)) {
+        return nil
+    }
+    return restoreArchive(s)
+}   // }}}
+
+func (self *ConfigOptions) unbind(s string) error { // {{{
+    if !self.dryRun {
+        return unbind(s, self.lockfile)
+    }
+    if isMountPoint(s) {
+        self.dry("umount %s", s)
+    }
+    self.dry("umount %s", getDiskMountPath(self.lockfile, s))
+    return nil
+}   // }}}
+
+// vim: set sts=4 ts=4 sw=4 et foldmethod=marker:
@@ -0,0 +1,142 @@
+// Copyright (C) 2012 Esa Määttä <esa.maatta@iki.fi>
+// This file is released under the GNU GPL, version 3 or a later revision.
+// For further details see the COPYING file.
+
+package main
+
+import (
+    "errors"
+    "os"
+    "os/user"
+    "strings"
+)
+
+// expandPath expands variables in a path read from the config file:
+//
+// A "~" or "~user" at the beginning of the path is replaced with the home
+// directory of the current or the given user. "$VAR" and "${VAR}" are
+// replaced with the value of the environment variable VAR, and "$$" with a
+// "$". Specifiers "%u", "%U" and "%h" are replaced with the name, id and home
+// directory of the current user, and "%%" with a "%".
+//
+// If HOME or USER is not in the environment, the value is taken from the user
+// database. Undefined variables and unknown specifiers are errors.
+func expandPath(p string) (string, error) { // {{{
+    var (
+        expanded []string
+        err      error
+    )
+
+    // Expand the tilde prefix
+    if strings.HasPrefix(p, "~") {
+        name := p[1:]
+        if i := strings.Index(name, "/"); i >= 0 {
+            name = name[:i]
+        }
+        var home string
+        if name == "" {
+            home, err = lookupVariable("HOME")
+        } else {
+            var u *user.User
+            if u, err = user.Lookup(name); err == nil {
+                home = u.HomeDir
+            }
+        }
+        if err != nil {
+            return "", err
+        }
+        expanded = append(expanded, home)
+        p = p[1+len(name):]
+    }
+
+    for i := 0; i < len(p); i++ {
+        switch c := p[i]; {
+        case c == '$' && i+1 < len(p) && p[i+1] == '$':
+            expanded = append(expanded, "$")
+            i++
+        case c == '$':
+            var name string
+            if i+1 < len(p) && p[i+1] == '{' {
+                end := strings.Index(p[i:], "}")
+                if end < 0 {
+                    return "", errors.New("Unterminated variable reference: " + p[i:])
+                }
+                name = p[i+2 : i+end]
+                i += end
+            } else {
+                end := i + 1
+                for end < len(p) && isVariableChar(p[end]) {
+                    end++
+                }
+                name = p[i+1 : end]
+                i = end - 1
+            }
+            if name == "" {
+                return "", errors.New("Empty variable name in: " + p)
+            }
+            var value string
+            if value, err = lookupVariable(name); err != nil {
+                return "", err
+            }
+            expanded = append(expanded, value)
+        case c == '%':
+            if i+1 >= len(p) {
+                return "", errors.New("Path ends with a '%': " + p)
+            }
+            i++
+            var value string
+            switch p[i] {
+            case 'u':
+                value, err = lookupVariable("USER")
+            case 'h':
+                value, err = lookupVariable("HOME")
+            case 'U':
+                value, err = currentUserField(func(u *user.User) string { return u.Uid })
+            case '%':
+                value = "%"
+            default:
+                err = errors.New("Unknown specifier '%" + p[i:i+1] + "' in: " + p)
+            }
+            if err != nil {
+                return "", err
+            }
+            expanded = append(expanded, value)
+        default:
+            expanded = append(expanded, p[i:i+1])
+        }
+    }
+    return strings.Join(expanded, ""), nil
+}   // }}}
+
+// isVariableChar checks whether given character can be part of a variable
+// name which is not in braces.
+func isVariableChar(c byte) bool { // {{{
+    return c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+}   // }}}
+
+// lookupVariable returns the value of given environment variable. HOME and
+// USER are taken from the user database if not in the environment.
+func lookupVariable(name string) (string, error) { // {{{
+    if value, ok := os.LookupEnv(name); ok {
+        return value, nil
+    }
+    switch name {
+    case "HOME":
+        return currentUserField(func(u *user.User) string { return u.HomeDir })
+    case "USER":
+        return currentUserField(func(u *user.User) string { return u.Username })
+    }
+    return "", errors.New("Undefined variable: " + name)
+}   // }}}
+
+// currentUserField returns a field of the current user selected with given
+// function.
+func currentUserField(field func(*user.User) string) (string, error) { // {{{
+    u, err := user.Current()
+    if err != nil {
+        return "", err
+    }
+    return field(u), nil
+}   // }}}
+
+// vim: set sts=4 ts=4 sw=4 et foldmethod=marker:
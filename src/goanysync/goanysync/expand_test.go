@@ -0,0 +1,130 @@
+// Copyright (C) 2012 Esa Määttä <esa.maatta@iki.fi>
+// This file is released under the GNU GPL, version 3 or a later revision.
+// For further details see the COPYING file.
+
+package main
+
+import (
+    "os"
+    "os/user"
+    "testing"
+)
+
+// unsetenv unsets environment variable name for the duration of the test.
+func unsetenv(t *testing.T, name string) { // {{{
+    // Setenv restores the original value at the end of the test
+    t.Setenv(name, "")
+    if err := os.Unsetenv(name); err != nil {
+        t.Fatal(err)
+    }
+}   // }}}
+
+func TestExpandPath(t *testing.T) { // {{{
+    t.Setenv("HOME", "/home/tester")
+    t.Setenv("USER", "tester")
+    t.Setenv("FOO", "foo")
+    t.Setenv("FOO_BAR", "foobar")
+    t.Setenv("EMPTY", "")
+    current, err := user.Current()
+    if err != nil {
+        t.Fatal(err)
+    }
+    root, err := user.Lookup("root")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    tests := []struct {
+        p    string
+        want string
+    }{
+        {"/var/cache", "/var/cache"},
+        {"", ""},
+        // Tilde prefix
+        {"~", "/home/tester"},
+        {"~/.cache", "/home/tester/.cache"},
+        {"~root/.cache", root.HomeDir + "/.cache"},
+        {"/a/~/b", "/a/~/b"},
+        // Variables
+        {"$HOME/.cache", "/home/tester/.cache"},
+        {"${HOME}/.cache", "/home/tester/.cache"},
+        {"/a/$FOO/b", "/a/foo/b"},
+        {"/a/${FOO}bar", "/a/foobar"},
+        {"/a/$FOO_BAR", "/a/foobar"},
+        {"/a/$FOO-bar", "/a/foo-bar"},
+        {"/a/$FOO.d", "/a/foo.d"},
+        {"/a/$EMPTY/b", "/a//b"},
+        {"~/$FOO", "/home/tester/foo"},
+        // Specifiers
+        {"/home/%u/.cache", "/home/tester/.cache"},
+        {"%h/.cache", "/home/tester/.cache"},
+        {"/run/user/%U", "/run/user/" + current.Uid},
+        {"/a/%u%u", "/a/testertester"},
+        // Escapes
+        {"/a/$$FOO", "/a/$FOO"},
+        {"/a/$$", "/a/$"},
+        {"/a/$$$FOO", "/a/$foo"},
+        {"/a/%%u", "/a/%u"},
+        {"/a/%%", "/a/%"},
+        {"/a/%%%u", "/a/%tester"},
+    }
+    for _, test := range tests {
+        got, err := expandPath(test.p)
+        if err != nil {
+            t.Errorf("expandPath(%q): unexpected error: %s", test.p, err)
+        } else if got != test.want {
+            t.Errorf("expandPath(%q) = %q, want %q", test.p, got, test.want)
+        }
+    }
+}   // }}}
+
+func TestExpandPathErrors(t *testing.T) { // {{{
+    unsetenv(t, "GOANYSYNC_UNDEFINED")
+    tests := []string{
+        "$GOANYSYNC_UNDEFINED/a",
+        "${GOANYSYNC_UNDEFINED}/a",
+        "/a/${FOO",
+        "/a/${}",
+        "/a/$",
+        "/a/$/b",
+        "/a/%",
+        "/a/%x",
+        "~goanysync-no-such-user/a",
+    }
+    for _, p := range tests {
+        if got, err := expandPath(p); err == nil {
+            t.Errorf("expandPath(%q) = %q, want an error", p, got)
+        }
+    }
+}   // }}}
+
+func TestExpandPathUserDatabase(t *testing.T) { // {{{
+    // HOME and USER are taken from the user database when not in the
+    // environment
+    unsetenv(t, "HOME")
+    unsetenv(t, "USER")
+    current, err := user.Current()
+    if err != nil {
+        t.Fatal(err)
+    }
+    tests := []struct {
+        p    string
+        want string
+    }{
+        {"~/.cache", current.HomeDir + "/.cache"},
+        {"$HOME/.cache", current.HomeDir + "/.cache"},
+        {"%h", current.HomeDir},
+        {"/home/%u", "/home/" + current.Username},
+        {"/home/$USER", "/home/" + current.Username},
+    }
+    for _, test := range tests {
+        got, err := expandPath(test.p)
+        if err != nil {
+            t.Errorf("expandPath(%q): unexpected error: %s", test.p, err)
+        } else if got != test.want {
+            t.Errorf("expandPath(%q) = %q, want %q", test.p, got, test.want)
+        }
+    }
+}   // }}}
+
+// vim: set sts=4 ts=4 sw=4 et foldmethod=marker:
@@ -0,0 +1,291 @@
+// Copyright (C) 2012 Esa Määttä <esa.maatta@iki.fi>
+// This file is released under the GNU GPL, version 3 or a later revision.
+// For further details see the COPYING file.
+
+package main
+
+import (
+    "errors"
+    "fmt"
+    "os"
+    "path"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// GENERATIONS_POSTFIX is appended to a sync path to get the directory where
+// its backup generations are kept.
+const GENERATIONS_POSTFIX = "-generations_goanysync"
+
+// getGenerationsPath returns the generations directory of given sync path.
+func getGenerationsPath(syncSource string) string { // {{{
+    return path.Clean(syncSource) + GENERATIONS_POSTFIX
+}   // }}}
+
+// readGenerations reads GENERATIONS option from given option data. Zero, the
+// default, disables generations.
+func readGenerations(data map[string]*string) (generations int, err error) { // {{{
+    if v, ok := data["GENERATIONS"]; ok {
+        if generations, err = strconv.Atoi(strings.TrimSpace(*v)); err != nil || generations < 0 {
+            err = errors.New("Invalid GENERATIONS: " + *v)
+            return
+        }
+    }
+    return
+}   // }}}
+
+// listGenerations returns the generations of given sync path, newest first.
+func listGenerations(syncSource string) (generations []string, err error) { // {{{
+    f, err := os.Open(getGenerationsPath(syncSource))
+    if err != nil {
+        if os.IsNotExist(err) {
+            err = nil
+        }
+        return
+    }
+    names, err := f.Readdirnames(-1)
+    f.Close()
+    if err != nil {
+        return
+    }
+    for _, n := range names {
+        if _, terr := time.ParseInLocation(SNAPSHOT_TIME_FORMAT, n, time.Local); terr == nil {
+            generations = append(generations, n)
+        }
+    }
+    // Time format sorts in chronological order
+    sort.Sort(sort.Reverse(sort.StringSlice(generations)))
+    return
+}   // }}}
+
+// findGeneration returns the path of a generation of given sync path. The
+// generation is given either by its name or by its number, 1 being the
+// newest.
+func findGeneration(syncSource string, generation string) (string, error) { // {{{
+    generations, err := listGenerations(syncSource)
+    if err != nil {
+        return "", err
+    }
+    if n, err := strconv.Atoi(generation); err == nil {
+        if n < 1 || n > len(generations) {
+            return "", fmt.Errorf("No generation %d, there are %d generations.", n, len(generations))
+        }
+        return path.Join(getGenerationsPath(syncSource), generations[n-1]), nil
+    }
+    for _, g := range generations {
+        if g == generation {
+            return path.Join(getGenerationsPath(syncSource), g), nil
+        }
+    }
+    return "", errors.New("No such generation: " + generation)
+}   // }}}
+
+// newGeneration makes a new generation of given backup path of a sync path
+// and removes the oldest generations so that keep generations remain. Files
+// which have not changed since the previous generation are hard-linked to
+// it, so unchanged files take no extra space.
+func newGeneration(syncSource string, backupPath string, keep int, cancel <-chan struct{}) error { // {{{
+    bfi, err := os.Stat(backupPath)
+    if err != nil {
+        return err
+    }
+    dir := getGenerationsPath(syncSource)
+    if err = os.MkdirAll(dir, 0700); err != nil {
+        return err
+    }
+    if err = copyOwner(dir, bfi); err != nil {
+        return err
+    }
+
+    generations, err := listGenerations(syncSource)
+    if err != nil {
+        return err
+    }
+    var prev string
+    if len(generations) > 0 {
+        prev = path.Join(dir, generations[0])
+    }
+
+    name := time.Now().Format(SNAPSHOT_TIME_FORMAT)
+    if exists(path.Join(dir, name)) {
+        return errors.New("Generation already exists: " + path.Join(dir, name))
+    }
+    // Build the generation to a temporary path so that an interrupted copy
+    // is never taken as a generation.
+    tmp := path.Join(dir, "."+name+".tmp")
+    if err = linkCopy(backupPath, tmp, prev, cancel); err != nil {
+        os.RemoveAll(tmp)
+        return err
+    }
+    if err = os.Rename(tmp, path.Join(dir, name)); err != nil {
+        os.RemoveAll(tmp)
+        return err
+    }
+    LOG.Debug("Created generation '%s' of sync source: %s", name, syncSource)
+
+    generations = append([]string{name}, generations...)
+    for i := keep; i < len(generations); i++ {
+        if err = removeAll(path.Join(dir, generations[i])); err != nil {
+            return err
+        }
+        LOG.Debug("Removed generation '%s' of sync source: %s", generations[i], syncSource)
+    }
+    return nil
+}   // }}}
+
+// linkCopy copies directory src to dst, which must not exist. Regular files
+// which are unchanged from the same file in directory prev are hard-linked to
+// it instead of copied. Sockets, pipes and devices are skipped.
+func linkCopy(src string, dst string, prev string, cancel <-chan struct{}) error { // {{{
+    // Attributes of dirs are set after their contents are copied, as copying
+    // changes their modification times.
+    type dir struct {
+        path string
+        fi   os.FileInfo
+    }
+    var dirs []dir
+
+    err := filepath.Walk(src, func(p string, fi os.FileInfo, err error) error {
+        if err != nil {
+            return err
+        }
+        if interrupted(cancel) {
+            return errInterrupted
+        }
+        rel, err := filepath.Rel(src, p)
+        if err != nil {
+            return err
+        }
+        d := filepath.Join(dst, rel)
+
+        switch mode := fi.Mode(); {
+        case mode.IsDir():
+            if err = os.Mkdir(d, 0700); err != nil {
+                return err
+            }
+            dirs = append(dirs, dir{d, fi})
+        case mode&os.ModeSymlink != 0:
+            var target string
+            if target, err = os.Readlink(p); err != nil {
+                return err
+            }
+            if err = os.Symlink(target, d); err != nil {
+                return err
+            }
+            return copyOwner(d, fi)
+        case mode.IsRegular():
+            if prev != "" && unchangedFile(filepath.Join(prev, rel), fi) {
+                return os.Link(filepath.Join(prev, rel), d)
+            }
+            if err = copyFile(p, d); err != nil {
+                return err
+            }
+            return copyAttributes(d, fi)
+        default:
+            LOG.Debug("Skipping special file: %s", p)
+        }
+        return nil
+    })
+    if err != nil {
+        return err
+    }
+
+    for i := len(dirs) - 1; i >= 0; i-- {
+        if err = copyAttributes(dirs[i].path, dirs[i].fi); err != nil {
+            return err
+        }
+    }
+    return nil
+}   // }}}
+
+// unchangedFile checks whether regular file p has the same mode, owner, size
+// and modification time as given file info.
+func unchangedFile(p string, fi os.FileInfo) bool { // {{{
+    pfi, err := os.Lstat(p)
+    if err != nil || pfi.Mode() != fi.Mode() || pfi.Size() != fi.Size() || !pfi.ModTime().Equal(fi.ModTime()) {
+        return false
+    }
+    puid, pgid, perr := getFileUserAndGroupId(pfi)
+    uid, gid, err := getFileUserAndGroupId(fi)
+    return perr == nil && err == nil && puid == uid && pgid == gid
+}   // }}}
+
+// restore replaces every given sync path with the given generation. The
+// current content of a path is lost, unless it's in a generation. A synced
+// path is restored only if unsyncPath is true, in which case it's synced back
+// and unsynced first, as a generation restored to its backup would be
+// overwritten by the next sync. Returns false if any of the restores failed.
+func restore(copts *ConfigOptions, syncSources *[]string, generation string, unsyncPath bool, cancel <-chan struct{}) bool { // {{{
+    st, err := readState(copts.lockfile)
+    if err != nil {
+        LOG.Warn("restore: Could not read the state file: %s", err)
+    }
+    synced := func(s string) bool {
+        return isSynced(s, copts.tmpfsPath) || isBound(s, copts.lockfile) || st.find(s) != nil
+    }
+
+    // Generations are found before the sync, which would add a generation
+    ok := true
+    generations := make(map[string]string)
+    var sources []string
+    for _, s := range *syncSources {
+        g, err := findGeneration(s, generation)
+        if err != nil {
+            LOG.Err("restore: %s: %s", s, err)
+            ok = false
+            continue
+        }
+        if synced(s) && !unsyncPath {
+            LOG.Err("restore: Sync path is currently synced, use --unsync to sync it back and unsync it first: %s", s)
+            ok = false
+            continue
+        }
+        generations[s] = g
+        sources = append(sources, s)
+    }
+
+    // No generation is made of the synced back content, so that the
+    // generation to restore is not removed as the oldest one.
+    var toUnsync []string
+    for _, s := range sources {
+        if synced(s) {
+            toUnsync = append(toUnsync, s)
+        }
+    }
+    if len(toUnsync) > 0 {
+        ucopts := *copts
+        ucopts.generations = 0
+        sync(&ucopts, &toUnsync, cancel)
+        unsync(&ucopts, &toUnsync, true, cancel)
+        if st, err = readState(copts.lockfile); err != nil {
+            LOG.Warn("restore: Could not read the state file: %s", err)
+        }
+    }
+
+    for _, s := range sources {
+        if interrupted(cancel) {
+            LOG.Warn("restore: Interrupted, skipping remaining sync sources.")
+            return false
+        }
+        if synced(s) {
+            LOG.Err("restore: Could not unsync sync path: %s", s)
+            ok = false
+            continue
+        }
+        g := generations[s]
+        syncer := &goSyncer{}
+        if err = syncer.Sync(g, s, cancel); err != nil {
+            logSyncError("restore", err)
+            LOG.Err("restore: Restoring generation '%s' failed for sync source: %s", path.Base(g), s)
+            ok = false
+            continue
+        }
+        LOG.Info("restore: Restored generation '%s' to '%s'.", path.Base(g), s)
+    }
+    return ok
+}   // }}}
+
+// vim: set sts=4 ts=4 sw=4 et foldmethod=marker:
@@ -0,0 +1,223 @@
+// Copyright (C) 2012 Esa Määttä <esa.maatta@iki.fi>
+// This file is released under the GNU GPL, version 3 or a later revision.
+// For further details see the COPYING file.
+
+package main
+
+import (
+    "bufio"
+    "fmt"
+    "os"
+    "path"
+    "path/filepath"
+    "sort"
+    "strings"
+)
+
+// GLOB_RECORD_POSTFIX is appended to the lock file path to get the path of the
+// file which records the expansion of glob patterns at start.
+const GLOB_RECORD_POSTFIX = ".paths"
+
+// isGlob checks whether given sync path is a glob pattern.
+func isGlob(p string) bool { // {{{
+    return strings.ContainsAny(p, "*?[")
+}   // }}}
+
+// getGlobRecordPath returns the path of the glob record file.
+func getGlobRecordPath(lockfile string) string { // {{{
+    return lockfile + GLOB_RECORD_POSTFIX
+}   // }}}
+
+// expandGlob returns directories matching given pattern. Symlinks to
+// directories match too, as an initialized sync path is a symlink. Backup
+// and generations paths are never matched.
+func expandGlob(pattern string) ([]string, error) { // {{{
+    matches, err := filepath.Glob(pattern)
+    if err != nil {
+        return nil, fmt.Errorf("Invalid pattern '%s': %s", pattern, err)
+    }
+    dirs := make([]string, 0, len(matches))
+    for _, m := range matches {
+        if strings.HasSuffix(m, BACKUP_POSTFIX) || strings.HasSuffix(m, GENERATIONS_POSTFIX) {
+            continue
+        }
+        if fi, err := os.Stat(m); err == nil && fi.IsDir() {
+            dirs = append(dirs, m)
+        }
+    }
+    return dirs, nil
+}   // }}}
+
+// readGlobRecord reads the glob record file. Returns a map from pattern to
+// the paths it was expanded to, or nil if the file does not exist.
+func readGlobRecord(fn string) (map[string][]string, error) { // {{{
+    f, err := os.Open(fn)
+    if err != nil {
+        if os.IsNotExist(err) {
+            return nil, nil
+        }
+        return nil, err
+    }
+    defer f.Close()
+
+    record := make(map[string][]string)
+    scanner := bufio.NewScanner(f)
+    for scanner.Scan() {
+        fields := strings.SplitN(scanner.Text(), "\t", 2)
+        if len(fields) != 2 {
+            return nil, fmt.Errorf("%s: Invalid line: %s", fn, scanner.Text())
+        }
+        record[fields[0]] = append(record[fields[0]], fields[1])
+    }
+    return record, scanner.Err()
+}   // }}}
+
+// writeGlobRecord writes given pattern to paths map to the glob record file
+// atomically, one "pattern<TAB>path" pair per line.
+func writeGlobRecord(fn string, record map[string][]string) error { // {{{
+    patterns := make([]string, 0, len(record))
+    for pattern := range record {
+        patterns = append(patterns, pattern)
+    }
+    sort.Strings(patterns)
+
+    tmp := fn + ".tmp"
+    f, err := os.Create(tmp)
+    if err != nil {
+        return err
+    }
+    bw := bufio.NewWriter(f)
+    for _, pattern := range patterns {
+        for _, p := range record[pattern] {
+            fmt.Fprintf(bw, "%s\t%s\n", pattern, p)
+        }
+    }
+    if err = bw.Flush(); err == nil {
+        err = f.Sync()
+    }
+    if cerr := f.Close(); err == nil {
+        err = cerr
+    }
+    if err != nil {
+        os.Remove(tmp)
+        return err
+    }
+    return os.Rename(tmp, fn)
+}   // }}}
+
+// expandSyncPaths replaces glob patterns in copts.syncPaths with the
+// directories they match. If record is true the patterns are expanded now and
+// the result is written to the glob record file. Recorded paths which are
+// still initialized according to the state file are kept in the record, and
+// in the sync paths if their pattern is, even if they no longer match, so
+// that they are restored at stop. Otherwise the recorded expansion is used,
+// so that sync and stop act on the same directories as start even if new
+// matches have appeared, and patterns are expanded now only when there is no
+// record of them.
+func expandSyncPaths(copts *ConfigOptions, record bool) error { // {{{
+    recordPath := getGlobRecordPath(copts.lockfile)
+
+    // A record which can not be read is replaced when recording
+    recorded, err := readGlobRecord(recordPath)
+    if err != nil && record {
+        LOG.Warn("Could not read the glob record file: %s", err)
+    } else if err != nil {
+        return err
+    }
+    var kept map[string][]string
+    if record {
+        kept = initializedGlobPaths(copts.lockfile, recorded)
+    }
+
+    paths := make([]string, 0, len(copts.syncPaths))
+    seen := make(map[string]bool)
+    expanded := make(map[string][]string)
+    for _, p := range copts.syncPaths {
+        matches := []string{p}
+        if isGlob(p) {
+            var ok bool
+            if matches, ok = recorded[p]; record || !ok {
+                if matches, err = expandGlob(p); err != nil {
+                    return err
+                }
+                matches = appendMissing(matches, kept[p])
+            }
+            expanded[p] = matches
+            LOG.Debug("Sync path pattern '%s' matched: %s", p, strings.Join(matches, ", "))
+        }
+        for _, m := range matches {
+            m = path.Clean(m)
+            if !seen[m] {
+                seen[m] = true
+                paths = append(paths, m)
+                if _, ok := copts.pathOrigins[m]; !ok {
+                    copts.pathOrigins[m] = copts.pathOrigins[p]
+                }
+            }
+        }
+    }
+    copts.syncPaths = paths
+
+    // A dry run changes nothing
+    if record && !copts.dryRun {
+        // Initialized paths of patterns removed from the config stay recorded
+        for pattern, ms := range kept {
+            if _, ok := expanded[pattern]; !ok {
+                expanded[pattern] = ms
+            }
+        }
+        if len(expanded) == 0 {
+            removeGlobRecord(copts.lockfile)
+            return nil
+        }
+        return writeGlobRecord(recordPath, expanded)
+    }
+    return nil
+}   // }}}
+
+// initializedGlobPaths returns the paths of given glob record which are
+// initialized according to the state file. If the state file can not be read
+// all recorded paths are returned, as none of them is known to be restored.
+func initializedGlobPaths(lockfile string, recorded map[string][]string) map[string][]string { // {{{
+    st, err := readState(lockfile)
+    if err != nil {
+        LOG.Warn("Could not read the state file, keeping all recorded sync paths of patterns: %s", err)
+        return recorded
+    }
+    kept := make(map[string][]string)
+    for pattern, matches := range recorded {
+        for _, m := range matches {
+            if st.find(m) != nil {
+                kept[pattern] = append(kept[pattern], m)
+            }
+        }
+    }
+    return kept
+}   // }}}
+
+// appendMissing appends the paths of b which are not in a to a.
+func appendMissing(a []string, b []string) []string { // {{{
+    for _, p := range b {
+        found := false
+        for _, q := range a {
+            if path.Clean(q) == path.Clean(p) {
+                found = true
+                break
+            }
+        }
+        if !found {
+            a = append(a, p)
+        }
+    }
+    return a
+}   // }}}
+
+// removeGlobRecord removes the glob record file after the sync paths have been
+// restored.
+func removeGlobRecord(lockfile string) { // {{{
+    if err := os.Remove(getGlobRecordPath(lockfile)); err != nil && !os.IsNotExist(err) {
+        LOG.Warn("Could not remove glob record file: %s", err)
+    }
+}   // }}}
+
+// vim: set sts=4 ts=4 sw=4 et foldmethod=marker:
@@ -0,0 +1,182 @@
+// Copyright (C) 2012 Esa Määttä <esa.maatta@iki.fi>
+// This file is released under the GNU GPL, version 3 or a later revision.
+// For further details see the COPYING file.
+
+package main
+
+import (
+    "os"
+    "path/filepath"
+    "reflect"
+    "sort"
+    "testing"
+)
+
+// makeDirs creates given dirs under dir.
+func makeDirs(t *testing.T, dir string, dirs ...string) { // {{{
+    for _, d := range dirs {
+        if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+            t.Fatal(err)
+        }
+    }
+}   // }}}
+
+func TestIsGlob(t *testing.T) { // {{{
+    tests := []struct {
+        p    string
+        want bool
+    }{
+        {"/home/user/.cache", false},
+        {"/home/*/.cache", true},
+        {"/home/user/.cach?", true},
+        {"/home/user[12]/.cache", true},
+        {"$HOME/.cache", false},
+        {"", false},
+    }
+    for _, test := range tests {
+        if got := isGlob(test.p); got != test.want {
+            t.Errorf("isGlob(%q) = %t, want %t", test.p, got, test.want)
+        }
+    }
+}   // }}}
+
+func TestExpandGlob(t *testing.T) { // {{{
+    dir := t.TempDir()
+    makeDirs(t, dir, "a/.cache", "b/.cache", "c", "d/.cache"+BACKUP_POSTFIX, "e/.cache"+GENERATIONS_POSTFIX, "f/.cache/sub")
+    if err := os.WriteFile(filepath.Join(dir, "c", ".cache"), nil, 0644); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.Symlink(filepath.Join(dir, "a", ".cache"), filepath.Join(dir, "g")); err != nil {
+        t.Fatal(err)
+    }
+    makeDirs(t, dir, "h")
+    if err := os.Symlink(filepath.Join(dir, "missing"), filepath.Join(dir, "h", ".cache")); err != nil {
+        t.Fatal(err)
+    }
+
+    tests := []struct {
+        pattern string
+        want    []string
+    }{
+        // Files, backups, generations and broken symlinks are not matched
+        {"*/.cache", []string{"a/.cache", "b/.cache", "f/.cache"}},
+        {"*/.cache*", []string{"a/.cache", "b/.cache", "f/.cache"}},
+        {"[ab]/.cache", []string{"a/.cache", "b/.cache"}},
+        {"?", []string{"a", "b", "c", "d", "e", "f", "g", "h"}},
+        {"x*/.cache", []string{}},
+    }
+    for _, test := range tests {
+        got, err := expandGlob(filepath.Join(dir, test.pattern))
+        if err != nil {
+            t.Errorf("expandGlob(%q): unexpected error: %s", test.pattern, err)
+            continue
+        }
+        want := make([]string, len(test.want))
+        for i, w := range test.want {
+            want[i] = filepath.Join(dir, w)
+        }
+        if !reflect.DeepEqual(got, want) {
+            t.Errorf("expandGlob(%q) = %q, want %q", test.pattern, got, want)
+        }
+    }
+
+    if _, err := expandGlob(filepath.Join(dir, "[")); err == nil {
+        t.Errorf("expandGlob(%q): want an error", "[")
+    }
+}   // }}}
+
+func TestGlobRecordRoundTrip(t *testing.T) { // {{{
+    fn := filepath.Join(t.TempDir(), "lock"+GLOB_RECORD_POSTFIX)
+    if record, err := readGlobRecord(fn); err != nil || record != nil {
+        t.Errorf("readGlobRecord of a missing file = %v, %v, want nil, nil", record, err)
+    }
+
+    want := map[string][]string{
+        "/home/*/.cache":   {"/home/a/.cache", "/home/b c/.cache"},
+        "/srv/[ab]/data":   {"/srv/a/data"},
+        "/var/cache/?ache": {"/var/cache/cache"},
+    }
+    if err := writeGlobRecord(fn, want); err != nil {
+        t.Fatal(err)
+    }
+    got, err := readGlobRecord(fn)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !reflect.DeepEqual(got, want) {
+        t.Errorf("readGlobRecord = %q, want %q", got, want)
+    }
+    if _, err = os.Stat(fn + ".tmp"); !os.IsNotExist(err) {
+        t.Errorf("Temporary record file left behind: %v", err)
+    }
+
+    if err = os.WriteFile(fn, []byte("no tab\n"), 0644); err != nil {
+        t.Fatal(err)
+    }
+    if _, err = readGlobRecord(fn); err == nil {
+        t.Errorf("readGlobRecord of an invalid line: want an error")
+    }
+}   // }}}
+
+func TestExpandSyncPathsKeepsInitialized(t *testing.T) { // {{{
+    dir := t.TempDir()
+    makeDirs(t, dir, "a/.cache", "c/.cache")
+    lockfile := filepath.Join(dir, "lock")
+    pattern := filepath.Join(dir, "*/.cache")
+    removed := filepath.Join(dir, "*/.removed")
+    recordPath := getGlobRecordPath(lockfile)
+
+    // b/.cache and d/.removed were initialized at an earlier start but no
+    // longer match, e/.cache was restored and a/.cache was not initialized.
+    err := writeGlobRecord(recordPath, map[string][]string{
+        pattern: {filepath.Join(dir, "a/.cache"), filepath.Join(dir, "b/.cache"), filepath.Join(dir, "e/.cache")},
+        removed: {filepath.Join(dir, "d/.removed")},
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    st := &State{Paths: []*PathState{
+        {Source: filepath.Join(dir, "b/.cache")},
+        {Source: filepath.Join(dir, "d/.removed")},
+    }}
+    if err = writeState(lockfile, st); err != nil {
+        t.Fatal(err)
+    }
+
+    copts := &ConfigOptions{syncPaths: []string{pattern}, lockfile: lockfile, pathOrigins: make(map[string]string)}
+    if err = expandSyncPaths(copts, true); err != nil {
+        t.Fatal(err)
+    }
+    wantPaths := []string{filepath.Join(dir, "a/.cache"), filepath.Join(dir, "c/.cache"), filepath.Join(dir, "b/.cache")}
+    if !reflect.DeepEqual(copts.syncPaths, wantPaths) {
+        t.Errorf("syncPaths = %q, want %q", copts.syncPaths, wantPaths)
+    }
+
+    got, err := readGlobRecord(recordPath)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, paths := range got {
+        sort.Strings(paths)
+    }
+    want := map[string][]string{
+        pattern: {filepath.Join(dir, "a/.cache"), filepath.Join(dir, "b/.cache"), filepath.Join(dir, "c/.cache")},
+        removed: {filepath.Join(dir, "d/.removed")},
+    }
+    if !reflect.DeepEqual(got, want) {
+        t.Errorf("record = %q, want %q", got, want)
+    }
+
+    // Without recording the recorded expansion is used
+    makeDirs(t, dir, "f/.cache")
+    copts = &ConfigOptions{syncPaths: []string{pattern}, lockfile: lockfile, pathOrigins: make(map[string]string)}
+    if err = expandSyncPaths(copts, false); err != nil {
+        t.Fatal(err)
+    }
+    sort.Strings(copts.syncPaths)
+    if !reflect.DeepEqual(copts.syncPaths, want[pattern]) {
+        t.Errorf("syncPaths from record = %q, want %q", copts.syncPaths, want[pattern])
+    }
+}   // }}}
+
+// vim: set sts=4 ts=4 sw=4 et foldmethod=marker:
@@ -19,13 +19,11 @@ import (
     "log/syslog"
     "math"
     "os"
-    "os/exec"
     "path"
     "path/filepath"
     "regexp"
     "strings"
     "syscall"
-    "time"
 )
 
 // Global logger
@@ -54,7 +52,7 @@ func mkdirAll(path string, perm os.FileMode, uid uint, gid uint) error { // {{{
         if dir.IsDir() {
             return nil
         }
-        return &os.PathError{"mkdir", path, syscall.ENOTDIR}
+        return &os.PathError{Op: "mkdir", Path: path, Err: syscall.ENOTDIR}
     }
 
     // Doesn't already exist; make sure parent does.
@@ -166,23 +164,16 @@ func pathNameGen(s string, tmpfs string, uid, gid uint) (volatilePath, backupPat
     return
 }   // }}}
 
-// getLock acquires the file lock.
-func getLock(lockName string) (bool, error) { // {{{
-    err := os.Mkdir(lockName, 0600)
-    if err != nil {
-        if os.IsExist(err) {
-            return false, nil
+// logSyncError logs an error returned by a Syncer. Output of a failed sync
+// command is logged line by line.
+func logSyncError(prefix string, err error) { // {{{
+    LOG.Err("%s: %s", prefix, err)
+    if cerr, ok := err.(*CommandError); ok {
+        for _, outputLine := range bytes.Split(cerr.Output, []byte("\n")) {
+            if len(bytes.Trim(outputLine, " \n")) > 0 {
+                LOG.Err("%s", outputLine)
+            }
         }
-        return false, err
-    }
-    return true, nil
-}   // }}}
-
-// releaseLock releases the file lock.
-func releaseLock(lockName string) { // {{{
-    if err := os.Remove(lockName); err != nil {
-        LOG.Emerg("releaseLock: %s", err)
-        panic(err)
     }
 }   // }}}
 
@@ -314,11 +305,37 @@ func checkVolatileForExtra(tmpfs string, syncSources *[]string, onlyFirst bool)
 
 // checkVolatile checks volatile TMPFS path for extra paths not in sync
 // sources. It doesn't do anything for an empty tmpfs path.
-func checkVolatile(tmpfsPath string, syncPaths *[]string) (ok bool) { // {{{
+func checkVolatile(copts *ConfigOptions, syncPaths *[]string) (ok bool) { // {{{
+    // Paths in the state file whose volatile path is gone are restored by
+    // checkAndFix.
+    st, err := readState(copts.lockfile)
+    if err != nil {
+        LOG.Warn("Could not read the state file: %s", err)
+    }
+    var sources []string
+    for _, ps := range st.extra(syncPaths) {
+        if exists(ps.VolatilePath) {
+            sources = append(sources, ps.Source)
+        }
+    }
+    if len(sources) > 0 {
+        LOG.Err("State file contained sync path(s) not in WHATTOSYNC: %s\n", strings.Join(sources, ", "))
+        return false
+    }
+
+    // TMPFS is searched for paths not in the state file, e.g. ones
+    // initialized by an earlier version which had no state file.
+    known := append([]string(nil), *syncPaths...)
+    if st != nil {
+        for _, ps := range st.Paths {
+            known = append(known, ps.Source)
+        }
+    }
+    tmpfsPath := copts.tmpfsPath
     if !exists(tmpfsPath) {
         return true
     }
-    if ok, extraPaths, extraBackupPaths, err := checkVolatileForExtra(tmpfsPath, syncPaths, true); !ok || err != nil {
+    if ok, extraPaths, extraBackupPaths, err := checkVolatileForExtra(tmpfsPath, &known, true); !ok || err != nil {
         if err != nil {
             LOG.Err("Volatile (TMPFS) directory checker returned an error: %s\n", err)
         } else {
@@ -338,12 +355,55 @@ func checkVolatile(tmpfsPath string, syncPaths *[]string) (ok bool) { // {{{
     return true
 }   // }}}
 
+// orphanPaths returns the paths which are still linked into TMPFS, or mounted
+// over, but are not in given sync sources. These are paths removed from
+// WHATTOSYNC after start. They are found from the state file and from TMPFS
+// volatile paths which have a matching backup and a symlink pointing to them.
+func orphanPaths(copts *ConfigOptions, syncSources *[]string) (orphans []string) { // {{{
+    found := make(map[string]bool)
+    add := func(s string) {
+        if !found[s] {
+            found[s] = true
+            orphans = append(orphans, s)
+            LOG.Warn("Sync path not in WHATTOSYNC is restored: %s", s)
+        }
+    }
+
+    st, err := readState(copts.lockfile)
+    if err != nil {
+        LOG.Warn("Could not read the state file: %s", err)
+    }
+    for _, ps := range st.extra(syncSources) {
+        if exists(ps.VolatilePath) {
+            add(ps.Source)
+        }
+    }
+
+    if !exists(copts.tmpfsPath) {
+        return
+    }
+    _, _, extraBackupPaths, err := checkVolatileForExtra(copts.tmpfsPath, syncSources, false)
+    if err != nil {
+        LOG.Warn("Volatile (TMPFS) directory checker returned an error: %s", err)
+        return
+    }
+    vbpRE := regexp.MustCompile(getVolatileBasePathRe(copts.tmpfsPath))
+    for _, volatilePath := range *extraBackupPaths {
+        s := volatilePath[vbpRE.FindStringIndex(volatilePath)[1]:]
+        // Broken symlinks to elsewhere are left for check to fix
+        if target, err := os.Readlink(s); err == nil && target == volatilePath {
+            add(s)
+        }
+    }
+    return
+}   // }}}
+
 // --------------------------------------------------------------------------
 
 // info shows currently used space and what and where data is stored and
 // synced. Also it tells if there is extra paths in the TMPFS directory which
 // are not in current WHATTOSYNC path list.
-func info(copts *ConfigOptions) { // {{{
+func info(copts *ConfigOptions, syncPaths *[]string) { // {{{
     var ( // {{{
         target     string
         uid, gid   uint
@@ -356,18 +416,32 @@ func info(copts *ConfigOptions) { // {{{
     )   // }}}
 
     fmt.Printf("Current base TMPFS path is: %s\n", copts.tmpfsPath)
+    printTmpfsInfo(copts.tmpfsPath)
+    st, serr := readState(copts.lockfile)
+    if serr != nil {
+        fmt.Printf("State file: %s\n", serr)
+    }
     fmt.Printf("Sync path info:\n")
-    for i, s := range copts.syncPaths {
+    for i, s := range *syncPaths {
         if _, uid, gid, err = isValidSource(s); err != nil {
             fmt.Printf("  %s\n", err)
             continue
         }
         ss, backupPath, _ := pathNameGen(s, copts.tmpfsPath, uid, gid)
+        ps := st.find(s)
+        if ps != nil {
+            ss, backupPath = ps.VolatilePath, ps.BackupPath
+        }
 
         colorStart, colorEnd = "", ""
         targetStr := " -> not a symlink."
+        bound := isBound(s, copts.lockfile)
         if target, err = os.Readlink(s); err == nil {
             targetStr = " -> " + target
+        } else if bound && isOverlay(s, copts.lockfile) {
+            targetStr, target = " -> overlay with upper layer "+ss, ss
+        } else if bound && isMountPoint(s) {
+            targetStr, target = " -> bind mount of "+ss, ss
         }
         if target != ss {
             colorStart, colorEnd = bgRed, reset
@@ -391,20 +465,54 @@ func info(copts *ConfigOptions) { // {{{
             totalSize = totalSize + size
         }
         fmt.Printf("  tmpfs path  : %s%s%s\n", colorStart, ss, colorEnd)
-        if size != 0 {
+        // The upper layer of an overlay holds only the modified files
+        if size != 0 && strings.HasPrefix(targetStr, " -> overlay") {
+            fmt.Printf("  upper size  : %dM\n", size)
+        } else if size != 0 {
             fmt.Printf("  tmpfs size  : %dM\n", size)
         }
 
         colorStart, colorEnd = "", ""
+        if isArchived(s) {
+            backupPath = getArchivePath(s)
+        } else if bound {
+            backupPath = getDiskMountPath(copts.lockfile, s)
+        }
         if !exists(backupPath) {
             colorStart = bgRed
             colorEnd = reset
         }
         fmt.Printf("  backup path : %s%s%s\n", colorStart, backupPath, colorEnd)
+
+        if generations, err := listGenerations(s); err != nil {
+            fmt.Printf("  generations : %s\n", err)
+        } else if len(generations) > 0 {
+            fmt.Printf("  generations : %s\n", getGenerationsPath(s))
+            for j, g := range generations {
+                fmt.Printf("    %d. %s\n", j+1, g)
+            }
+        }
+
+        if ps != nil {
+            lastSync := "never"
+            if !ps.LastSync.IsZero() {
+                lastSync = ps.LastSync.Format(STATE_TIME_FORMAT)
+            }
+            fmt.Printf("  initialized : %s (%s, %s)\n", ps.InitTime.Format(STATE_TIME_FORMAT), ps.Mode, ps.Backing)
+            fmt.Printf("  last sync   : %s\n", lastSync)
+        }
     }
     fmt.Printf("---------- Total space of TMPFS used: %dM\n", totalSize)
 
-    if ok, extraPaths, extraBackupPaths, err := checkVolatileForExtra(copts.tmpfsPath, &copts.syncPaths, false); !ok || err != nil {
+    // Without a state file TMPFS is searched for unknown volatile paths
+    if st != nil {
+        if extra := st.extra(&copts.syncPaths); len(extra) > 0 {
+            fmt.Printf("\nState file contained paths which were not in WHATTOSYNC paths:\n\n")
+            for _, ps := range extra {
+                fmt.Printf("  %s -> %s\n", ps.Source, ps.VolatilePath)
+            }
+        }
+    } else if ok, extraPaths, extraBackupPaths, err := checkVolatileForExtra(copts.tmpfsPath, &copts.syncPaths, false); !ok || err != nil {
         if err != nil {
             fmt.Printf("TMPFS directory checker returned an error: %s\n", err)
         } else {
@@ -428,10 +536,40 @@ func info(copts *ConfigOptions) { // {{{
 
 // checkAndFix checks if any sync sources where synced but not finally unsynced.
 // Restores such sources from backup path to original state.
-func checkAndFix(tmpfs string, syncSources *[]string) { // {{{
+func checkAndFix(copts *ConfigOptions, syncSources *[]string) { // {{{
     LOG.Debug("checkAndFix: Checking for inconsistencies...")
-    for _, s := range *syncSources {
-        _, backupPath, volatilePathRe := pathNameGen(s, tmpfs, 0, 0)
+    st, err := readState(copts.lockfile)
+    if err != nil {
+        LOG.Warn("checkAndFix: Could not read the state file: %s", err)
+    }
+    // Paths in the state file are checked even if they are no longer in the
+    // config.
+    sources := append([]string(nil), *syncSources...)
+    for _, ps := range st.extra(syncSources) {
+        sources = append(sources, ps.Source)
+    }
+    for _, s := range sources {
+        if ps := st.find(s); ps != nil {
+            fixFromState(copts, ps)
+            continue
+        }
+
+        // Without a state the paths are found out from the current config
+        _, backupPath, volatilePathRe := pathNameGen(s, copts.tmpfsPath, 0, 0)
+
+        // A bind-mounted path whose volatile path is not mounted over it has
+        // its disk copy in place, so only the disk mount is removed. After a
+        // reboot there are no mounts but the disk mount path may remain.
+        if isBound(s, copts.lockfile) {
+            if !isMountPoint(s) {
+                if err := copts.unbind(s); err != nil {
+                    LOG.Err("checkAndFix (bind): %s: %s", s, err)
+                }
+            }
+            continue
+        } else if exists(getDiskMountPath(copts.lockfile, s)) {
+            copts.removeDiskMountPath(s)
+        }
 
         vpMatch := func(p string, s string) bool {
             var match bool
@@ -446,48 +584,105 @@ func checkAndFix(tmpfs string, syncSources *[]string) { // {{{
         // called. In this case the 's' path is a broken symlink to the
         // volatilePath and the backupPath exists.
         if target, err := os.Readlink(s); err == nil && vpMatch(volatilePathRe, target) && !exists(target) && exists(backupPath) {
-            os.Remove(s)
-            os.Rename(backupPath, s)
+            copts.remove(s)
+            copts.rename(backupPath, s)
+        } else if err == nil && vpMatch(volatilePathRe, target) && !exists(target) && isArchived(s) {
+            if err := copts.restoreArchive(s); err != nil {
+                LOG.Err("checkAndFix (archive): %s: %s", s, err)
+            }
         }
     }
     LOG.Debug("checkAndFix: ...completed check.")
     return
 }   // }}}
 
+// fixFromState restores a sync path whose volatile path recorded in the state
+// file has been deleted, and removes the path from the state file.
+func fixFromState(copts *ConfigOptions, ps *PathState) { // {{{
+    s := ps.Source
+    if exists(ps.VolatilePath) {
+        return
+    }
+    var err error
+    switch target, lerr := os.Readlink(s); {
+    case ps.Mode != MODE_SYMLINK:
+        // Mounts do not survive a reboot, but the disk mount path and the
+        // overlay work dir may remain.
+        if isBound(s, copts.lockfile) && isMountPoint(s) {
+            err = errors.New("Volatile path was deleted while it was mounted.")
+        } else if isBound(s, copts.lockfile) {
+            err = copts.unbind(s)
+        } else {
+            copts.removeDiskMountPath(s)
+        }
+        if workPath := getOverlayWorkPath(ps.Tmpfs, s); err == nil && exists(workPath) {
+            copts.removeVolatilePath(workPath, ps.Tmpfs)
+        }
+    case lerr != nil || target != ps.VolatilePath:
+        err = errors.New("Sync path was not a symlink to the volatile path: " + ps.VolatilePath)
+    case ps.Backing == BACKING_ARCHIVE:
+        err = copts.restoreArchive(s)
+    default:
+        if err = copts.remove(s); err == nil {
+            err = copts.rename(ps.BackupPath, s)
+        }
+    }
+    if err != nil {
+        LOG.Err("checkAndFix: %s: %s", s, err)
+        return
+    }
+    LOG.Info("checkAndFix: Restored sync source: %s", s)
+    recordUnsync(copts, s)
+}   // }}}
+
 // initSync does initial preparation for syncing and if preparations already
 // done it does nothing so it should be safe to call in any case. Initial
 // preparation incorporates following acts: 1. Replacement of given paths in
 // syncSources with symlinks to directories under given tmpfs path. 2. Creation
 // of a backup directory for every syncSource path.
-func initSync(tmpfs string, syncSources *[]string, syncerBin string) error { // {{{
+//
+// If cancel is closed, the initial sync of the current path is stopped and
+// the path is restored to its original state. Remaining paths are skipped and
+// errInterrupted is returned.
+func initSync(copts *ConfigOptions, syncSources *[]string, cancel <-chan struct{}) error { // {{{
     LOG.Debug("initSync: Starting initial sync run...")
-    for _, s := range *syncSources {
+    tmpfs := copts.tmpfsPath
+    // Paths are copied in priority order, so that the most important ones
+    // get the TMPFS space first.
+    for _, s := range byPriority(copts, *syncSources) {
         var (
             fi       os.FileInfo
             uid, gid uint
             err      error
         )
 
+        if interrupted(cancel) {
+            LOG.Warn("initSync: Interrupted, skipping remaining sync sources.")
+            return errInterrupted
+        }
+
         // Create initial tmpfs base dir
-        if err := os.Mkdir(tmpfs, 0711); err != nil && !os.IsExist(err) {
+        if err := copts.mkdir(tmpfs, 0711); err != nil && !os.IsExist(err) {
             emsg := fmt.Sprintf("initSync: Creation of tmpfs dir '%s' failed...: %s", tmpfs, err)
             return errors.New(emsg)
         }
 
         // Base tmpfs dir needs at least 0111 (+x) for every user
-        // (Mkdir uses umask so we need to chmod.)
+        // (Mkdir uses umask so we need to chmod.) In the dry run mode the
+        // dir may not exist.
         d, serr := os.Stat(tmpfs)
-        if serr != nil {
+        if serr != nil && !(copts.dryRun && os.IsNotExist(serr)) {
             emsg := fmt.Sprintf("initSync: tmpfs path '%s' access error: %s", tmpfs, serr)
             return errors.New(emsg)
         }
-        if m := d.Mode(); m&0111 != 0111 {
-            if err := os.Chmod(tmpfs, m|0111); err != nil {
+        if m := os.FileMode(0711); serr == nil && d.Mode()&0111 != 0111 {
+            m = d.Mode()
+            if err := copts.chmod(tmpfs, m|0111); err != nil {
                 emsg := fmt.Sprintf("initSync: Changing permissions of tmpfs dir '%s' failed...: %s", tmpfs, err)
                 return errors.New(emsg)
             }
             lmsg := fmt.Sprintf("initSync: Changed '%s' permissions from '%s' -> '%s'.", tmpfs, m, m|0111)
-            LOG.Info(lmsg)
+            LOG.Info("%s", lmsg)
         }
 
         if fi, uid, gid, err = isValidSource(s); err != nil {
@@ -499,27 +694,96 @@ func initSync(tmpfs string, syncSources *[]string, syncerBin string) error { //
         // Volatile dirs name is based on orginal dir's name, uid and gid
         volatilePath, backupPath, _ := pathNameGen(s, tmpfs, uid, gid)
 
+        // Paths which are not initialized yet must fit in TMPFS. Nothing is
+        // copied in overlay mode.
+        if target, _ := os.Readlink(s); target != volatilePath && !isBound(s, copts.lockfile) && copts.options(s).mode != MODE_OVERLAY {
+            if err := checkFreeSpace(s, tmpfs, copts.headroom); err != nil {
+                LOG.Warn("initSync: %s", err)
+                LOG.Warn("initSync: Skipping sync source: %s", s)
+                continue
+            }
+        }
+
         // First check if our target directory in tmpfs is ready.
         // We must ensure that the original owner of the source directory can
         // read the tmpfs volatile target dir, so we use the originals
         // permissions.
-        if err := mkdirAll(volatilePath, fi.Mode(), uid, gid); err != nil { // {{{
+        if err := copts.mkdirAll(volatilePath, fi.Mode(), uid, gid); err != nil { // {{{
             LOG.Warn("initSync (volatile path creation): %s", err)
             LOG.Warn("initSync: Skipping sync source: %s", s)
             continue
         }   // }}}
 
+        if isBound(s, copts.lockfile) {
+            LOG.Debug("initSync: sync path was already bind-mounted: %s", s)
+            continue
+        }
+
         // Second check if we need to create initial backup and initial sync to
         // volatile
         if target, err := os.Readlink(s); err != nil || target != volatilePath { // {{{
+            // With archive backing the persistent copy is an archive instead
+            // of the backup dir.
+            if copts.options(s).backing == BACKING_ARCHIVE {
+                if copts.dry("tar -czf %s -C %s . && tar -xzf %s -C %s && rm -r %s && ln -s %s %s",
+                    getArchivePath(s), s, getArchivePath(s), volatilePath, s, volatilePath, s) {
+                    continue
+                }
+                if err := initArchive(s, volatilePath, cancel); err != nil {
+                    LOG.Err("initSync (archive): %s", err)
+                    LOG.Err("initSync: Skipping sync source: %s", s)
+                    if err == errInterrupted {
+                        LOG.Warn("initSync: Interrupted, skipping remaining sync sources.")
+                        return errInterrupted
+                    }
+                } else {
+                    recordInit(copts, s, volatilePath, fi, uid, gid)
+                }
+                continue
+            }
+            // In bind mode the volatile path is mounted over the sync path
+            // and the disk copy stays reachable from the disk mount path.
+            if copts.options(s).mode == MODE_BIND {
+                if diskPath := getDiskMountPath(copts.lockfile, s); copts.dry("mount --bind %s %s", s, diskPath) {
+                    copts.options(s).syncer.Sync(diskPath, volatilePath, cancel)
+                    copts.dry("mount --bind %s %s", volatilePath, s)
+                    continue
+                }
+                if err := initBind(s, volatilePath, copts.lockfile, copts.options(s).syncer, cancel); err != nil {
+                    logSyncError("initSync (bind)", err)
+                    LOG.Err("initSync: Skipping sync source: %s", s)
+                    if err == errInterrupted {
+                        LOG.Warn("initSync: Interrupted, skipping remaining sync sources.")
+                        return errInterrupted
+                    }
+                } else {
+                    recordInit(copts, s, volatilePath, fi, uid, gid)
+                }
+                continue
+            }
+            // In overlay mode only modified files are copied to tmpfs
+            if copts.options(s).mode == MODE_OVERLAY {
+                if diskPath := getDiskMountPath(copts.lockfile, s); copts.dry("mount --bind %s %s", s, diskPath) {
+                    copts.dry("mount -t overlay -o lowerdir=%s,upperdir=%s,workdir=%s overlay %s",
+                        diskPath, volatilePath, getOverlayWorkPath(tmpfs, s), s)
+                    continue
+                }
+                if err := initOverlay(s, volatilePath, tmpfs, copts.lockfile); err != nil {
+                    LOG.Err("initSync (overlay): %s", err)
+                    LOG.Err("initSync: Skipping sync source: %s", s)
+                } else {
+                    recordInit(copts, s, volatilePath, fi, uid, gid)
+                }
+                continue
+            }
             // trying to rename the target path
-            if err := os.Rename(s, backupPath); err != nil {
+            if err := copts.rename(s, backupPath); err != nil {
                 LOG.Warn("initSync: could not rename target path: %s", err)
                 LOG.Warn("initSync: Skipping sync source: %s", s)
                 continue
             }
             // create symlink from original path to volatile path
-            if linkError := os.Symlink(volatilePath, s); linkError != nil {
+            if linkError := copts.symlink(volatilePath, s); linkError != nil {
                 LOG.Warn("initSync (symlink): %s", err)
                 LOG.Warn("initSync: Skipping sync source: %s", s)
                 // Restore orginal state
@@ -530,14 +794,8 @@ func initSync(tmpfs string, syncSources *[]string, syncerBin string) error { //
                 continue
             }
             // Let's do initial sync to volatile
-            cmd := exec.Command(syncerBin, "-a", "--delete", backupPath+"/", s)
-            if output, err := cmd.CombinedOutput(); err != nil {
-                LOG.Err("initSync (volatile): '%s' => with command: %s", err, strings.Join(cmd.Args, " "))
-                for _, outputLine := range bytes.Split(output, []byte("\n")) {
-                    if len(bytes.Trim(outputLine, " \n")) > 0 {
-                        LOG.Err(string(outputLine))
-                    }
-                }
+            if err := copts.options(s).syncer.Sync(backupPath, s, cancel); err != nil {
+                logSyncError("initSync (volatile)", err)
                 LOG.Err("initSync: Skipping sync source: %s", s)
                 // Restore orginal state
                 if err := os.Remove(s); err != nil {
@@ -548,6 +806,12 @@ func initSync(tmpfs string, syncSources *[]string, syncerBin string) error { //
                     errMsg := fmt.Sprintf("initsync: After sync command error, restoring '%s' -> '%s' failed: %s\n", backupPath, s, err)
                     return errors.New(errMsg)
                 }
+                if err == errInterrupted {
+                    LOG.Warn("initSync: Interrupted, skipping remaining sync sources.")
+                    return errInterrupted
+                }
+            } else {
+                recordInit(copts, s, volatilePath, fi, uid, gid)
             }
             continue
         } else {
@@ -559,15 +823,33 @@ func initSync(tmpfs string, syncSources *[]string, syncerBin string) error { //
 }   // }}}
 
 // sync syncs content from tmpfs paths to backup paths. It expects that initSync
-// has been called for the syncSources.
-func sync(tmpfs string, syncSources *[]string, syncerBin string) { // {{{
+// has been called for the syncSources. If cancel is closed, the sync of the
+// current path is completed and remaining paths are skipped. Paths which have
+// writeback disabled are not synced.
+func sync(copts *ConfigOptions, syncSources *[]string, cancel <-chan struct{}) { // {{{
     LOG.Debug("sync: Starting...")
+    tmpfs := copts.tmpfsPath
+    st, err := readState(copts.lockfile)
+    if err != nil {
+        LOG.Warn("sync: Could not read the state file: %s", err)
+    }
     for _, s := range *syncSources {
         var (
             uid, gid uint
             err      error
         )
 
+        if interrupted(cancel) {
+            LOG.Warn("sync: Interrupted, skipping remaining sync sources.")
+            return
+        }
+
+        popts := copts.options(s)
+        if !popts.writeback {
+            LOG.Debug("sync: Writeback disabled, skipping sync source: %s", s)
+            continue
+        }
+
         if _, uid, gid, err = isValidSource(s); err != nil {
             LOG.Warn("sync: %s", err)
             LOG.Warn("sync: Skipping sync source: %s", s)
@@ -576,6 +858,10 @@ func sync(tmpfs string, syncSources *[]string, syncerBin string) { // {{{
 
         // Volatile dirs name is based on orginal dir's name, uid and gid
         volatilePath, backupPath, _ := pathNameGen(s, tmpfs, uid, gid)
+        // The state file has the volatile path the path was initialized with
+        if ps := st.find(s); ps != nil {
+            volatilePath = ps.VolatilePath
+        }
 
         // Volatile path must exists
         if !exists(volatilePath) {
@@ -585,13 +871,41 @@ func sync(tmpfs string, syncSources *[]string, syncerBin string) { // {{{
             continue
         }
 
-        // Target must be a symlink to the volatile path
-        if target, err := os.Readlink(s); err != nil || target != volatilePath { // {{{
+        // The disk copy of a bind-mounted path is at its disk mount path.
+        // With an overlay the disk copy is its lower layer.
+        overlay := false
+        if st.bound(s, copts.lockfile) {
+            overlay = isOverlay(s, copts.lockfile)
+            if !isMountPoint(s) {
+                LOG.Warn("sync (volatile path was not mounted): %s", s)
+                LOG.Warn("sync: Skipping sync source: %s", s)
+                continue
+            }
+            backupPath = getDiskMountPath(copts.lockfile, s)
+        } else if target, err := os.Readlink(s); err != nil || target != volatilePath { // {{{
+            // Target must be a symlink to the volatile path
             LOG.Warn("sync (volatile path was not linked): %s", err)
             LOG.Warn("sync: Skipping sync source: %s", s)
             continue
         }   // }}}
 
+        // With archive backing the archive is rewritten
+        if st.archived(s) {
+            if err := copts.writeTarGz(volatilePath, getArchivePath(s)); err != nil {
+                LOG.Err("sync (archive): %s", err)
+                LOG.Err("Sync: backup failed for sync source: %s", s)
+                continue
+            }
+            recordSync(copts, s)
+            if copts.snapshot.afterSync && !copts.dry("snapshot of %s", s) {
+                if err := takeSnapshot(copts.snapshot, s, volatilePath, cancel); err != nil {
+                    LOG.Err("sync (snapshot): %s: %s", s, err)
+                }
+            }
+            LOG.Debug("sync: synced dir '%s' to archive.", s)
+            continue
+        }
+
         // Backup path must exists
         if !exists(backupPath) {
             // syncInit failed or not called for the sync path
@@ -601,17 +915,29 @@ func sync(tmpfs string, syncSources *[]string, syncerBin string) { // {{{
         }
 
         // Everything was ok, so we just sync from volatile tmpfs to backup
-        cmd := exec.Command(syncerBin, "-a", "--delete", s+"/", backupPath)
-        if output, err := cmd.CombinedOutput(); err != nil { // {{{
-            LOG.Err("sync (backup): '%s' => with command: %s", err, strings.Join(cmd.Args, " "))
-            for _, outputLine := range bytes.Split(output, []byte("\n")) {
-                if len(bytes.Trim(outputLine, " \n")) > 0 {
-                    LOG.Err(string(outputLine))
-                }
+        if overlay {
+            if err := copts.mergeUpper(volatilePath, backupPath); err != nil {
+                LOG.Err("sync (overlay): %s", err)
+                LOG.Err("Sync: backup failed for sync source: %s", s)
+                continue
             }
+        } else if err := popts.syncer.Sync(s, backupPath, nil); err != nil { // {{{
+            logSyncError("sync (backup)", err)
             LOG.Err("Sync: backup failed for sync source: %s", s)
             continue
         }   // }}}
+        recordSync(copts, s)
+
+        if copts.generations > 0 && !copts.dry("new backup generation of %s", s) {
+            if err := newGeneration(s, backupPath, copts.generations, cancel); err != nil {
+                LOG.Err("sync (generation): %s: %s", s, err)
+            }
+        }
+        if copts.snapshot.afterSync && !copts.dry("snapshot of %s", s) {
+            if err := takeSnapshot(copts.snapshot, s, backupPath, cancel); err != nil {
+                LOG.Err("sync (snapshot): %s: %s", s, err)
+            }
+        }
 
         LOG.Debug("sync: synced dir '%s'.", s)
     }
@@ -620,13 +946,25 @@ func sync(tmpfs string, syncSources *[]string, syncerBin string) { // {{{
 }   // }}}
 
 // unsync removes symbolic linkin to tmpfs and restores original from backup.
-func unsync(tmpfs string, syncSources *[]string, removeVolatile bool) { // {{{
+// If cancel is closed, the current path is restored and remaining paths are
+// skipped. Skipped paths are restored from backup by the next check command.
+func unsync(copts *ConfigOptions, syncSources *[]string, removeVolatile bool, cancel <-chan struct{}) { // {{{
     LOG.Debug("unsync: Starting...")
+    tmpfs := copts.tmpfsPath
+    st, err := readState(copts.lockfile)
+    if err != nil {
+        LOG.Warn("unsync: Could not read the state file: %s", err)
+    }
     for _, s := range *syncSources {
         var (
             uid, gid uint
             err      error
         )
+
+        if interrupted(cancel) {
+            LOG.Warn("unsync: Interrupted, skipping remaining sync sources.")
+            return
+        }
         if _, uid, gid, err = isValidSource(s); err != nil {
             LOG.Warn("unsync: %s", err)
             LOG.Warn("unsync: Skipping sync source: %s", s)
@@ -634,6 +972,52 @@ func unsync(tmpfs string, syncSources *[]string, removeVolatile bool) { // {{{
         }
         volatilePath, backupPath, _ := pathNameGen(s, tmpfs, uid, gid)
 
+        // A path recorded in the state file is restored with the paths it
+        // was initialized with, even if the config has changed since.
+        vtmpfs := tmpfs
+        if ps := st.find(s); ps != nil {
+            volatilePath, vtmpfs = ps.VolatilePath, ps.Tmpfs
+            if ps.Mode == MODE_SYMLINK && ps.Backing == BACKING_DIR {
+                backupPath = ps.BackupPath
+            }
+        }
+
+        // Unmounting a bind-mounted path brings its disk copy back in place
+        if st.bound(s, copts.lockfile) {
+            if err := copts.unbind(s); err != nil {
+                LOG.Err("unsync (bind): %s", err)
+                LOG.Err("unsync: Skipping sync source: %s", s)
+                continue
+            }
+            if workPath := getOverlayWorkPath(vtmpfs, s); exists(workPath) {
+                copts.removeVolatilePath(workPath, vtmpfs)
+            }
+            if removeVolatile {
+                copts.removeVolatilePath(volatilePath, vtmpfs)
+            }
+            recordUnsync(copts, s)
+            continue
+        }
+
+        // With archive backing the sync source is restored from the archive
+        if st.archived(s) {
+            if target, err := os.Readlink(s); err != nil || target != volatilePath {
+                LOG.Warn("unsync (volatile): %s", err)
+                LOG.Warn("unsync: Skipping sync source: %s", s)
+                continue
+            }
+            if err := copts.restoreArchive(s); err != nil {
+                LOG.Err("unsync (archive): %s", err)
+                LOG.Err("unsync: Skipping sync source: %s", s)
+                continue
+            }
+            if removeVolatile {
+                copts.removeVolatilePath(volatilePath, vtmpfs)
+            }
+            recordUnsync(copts, s)
+            continue
+        }
+
         // Check that backup path exists and is a directory
         if fi, err := os.Stat(backupPath); err != nil || !fi.IsDir() { // {{{
             LOG.Warn("unsync (backup): %s", err)
@@ -649,8 +1033,8 @@ func unsync(tmpfs string, syncSources *[]string, removeVolatile bool) { // {{{
         }   // }}}
 
         // Remove the link and replace it with backup
-        os.Remove(s) // TODO: how we should react to an error from this?
-        if err := os.Rename(backupPath, s); err != nil {
+        copts.remove(s) // TODO: how we should react to an error from this?
+        if err := copts.rename(backupPath, s); err != nil {
             LOG.Err("unsync: While trying to rename backup '%s' to '%s': %s", backupPath, s, err)
             continue
         }
@@ -658,24 +1042,110 @@ func unsync(tmpfs string, syncSources *[]string, removeVolatile bool) { // {{{
         // Removing volatile after unsync makes checking that everything is
         // synced back to disk easier.
         if removeVolatile {
-            if err := os.RemoveAll(volatilePath); err != nil {
-                LOG.Err("unsync: While trying to remove volatile path: %s", err)
-            }
-            // Remove empty parents until base TMPFS dir
-            volatileParent := path.Clean(volatilePath)
-            cleanTmpfs := path.Clean(tmpfs)
-            for rerr := error(nil); rerr == nil; rerr = os.Remove(volatileParent) {
-                volatileParent = path.Dir(volatileParent)
-                if cleanTmpfs == volatileParent {
-                    break
-                }
-            }
+            copts.removeVolatilePath(volatilePath, vtmpfs)
         }
+        recordUnsync(copts, s)
     }
     LOG.Debug("unsync: ...completed.")
     return
 }   // }}}
 
+// removeVolatilePath removes given volatile path and its empty parents until
+// the base TMPFS dir.
+func removeVolatilePath(volatilePath string, tmpfs string) { // {{{
+    if err := removeAll(volatilePath); err != nil {
+        LOG.Err("unsync: While trying to remove volatile path: %s", err)
+    }
+    // Remove empty parents until base TMPFS dir
+    volatileParent := path.Clean(volatilePath)
+    cleanTmpfs := path.Clean(tmpfs)
+    for rerr := error(nil); rerr == nil; rerr = os.Remove(volatileParent) {
+        volatileParent = path.Dir(volatileParent)
+        if cleanTmpfs == volatileParent {
+            break
+        }
+    }
+}   // }}}
+
+// selectSyncPaths returns the sync paths given on the command line in the
+// order they are in the config. Relative paths are relative to the current
+// working directory. It's an error if a given path is not a sync path.
+func selectSyncPaths(copts *ConfigOptions, args []string) (syncPaths []string, err error) { // {{{
+    selected := make(map[string]bool)
+    for _, a := range args {
+        var p string
+        if p, err = filepath.Abs(a); err != nil {
+            return
+        }
+        found := false
+        for _, s := range copts.syncPaths {
+            if path.Clean(s) == p {
+                selected[s], found = true, true
+            }
+        }
+        if !found {
+            err = errors.New("Path not in WHATTOSYNC: " + a)
+            return
+        }
+    }
+    for _, s := range copts.syncPaths {
+        if selected[s] {
+            syncPaths = append(syncPaths, s)
+        }
+    }
+    return
+}   // }}}
+
+// --------------------------------------------------------------------------
+
+// start runs the check and initsync commands. Before that it checks that the
+// TMPFS path is on a RAM-backed file system and does not contain any extra
+// paths which are not in syncPaths and might not be synced back. Returns false if any of the steps failed.
+func start(copts *ConfigOptions, cancel <-chan struct{}) bool { // {{{
+    if err := checkTmpfsFileSystem(copts.tmpfsPath, copts.tmpfsCheck); err != nil {
+        LOG.Err("start: %s", err)
+        return false
+    }
+    if ok := checkVolatile(copts, &copts.syncPaths); !ok {
+        return false
+    }
+    checkAndFix(copts, &copts.syncPaths)
+    if err := initSync(copts, &copts.syncPaths, cancel); err != nil {
+        LOG.Err("%s", err)
+        return false
+    }
+    return true
+}   // }}}
+
+// stop runs the sync and unsync commands and checks afterwards that every
+// volatile path was synced back. Returns false if the check failed or if the
+// stop was interrupted.
+func stop(copts *ConfigOptions, cancel <-chan struct{}) bool { // {{{
+    // Paths removed from WHATTOSYNC since start are synced back too, so that
+    // their data is not lost with TMPFS.
+    syncPaths := append([]string(nil), copts.syncPaths...)
+    syncPaths = append(syncPaths, orphanPaths(copts, &copts.syncPaths)...)
+    sync(copts, &syncPaths, cancel)
+    unsync(copts, &syncPaths, true, cancel)
+    if interrupted(cancel) {
+        return false
+    }
+    // Nothing was restored in a dry run, so there is nothing to check
+    if copts.dryRun {
+        return true
+    }
+    // If not all volatile paths were synced back issue a warning
+    // XXX: checkVolatile actually warns only about volatile paths not in
+    // syncPaths, so if unsync left something from syncPaths unsynced then
+    // checkVolatile would not notice a problem.
+    if ok := checkVolatile(copts, &copts.syncPaths); !ok {
+        return false
+    }
+    // Glob patterns are expanded again at the next start
+    removeGlobRecord(copts.lockfile)
+    return true
+}   // }}}
+
 // --------------------------------------------------------------------------
 
 // runMain is a main function which returns programs exit value.
@@ -695,8 +1165,12 @@ func runMain() int {
     configFilePath := flag.String("c", "/etc/goanysync.conf", "Config file.")
     verbose := flag.Bool("v", false, "Be more verbose with console messages.")
     syslogLogLevel := flag.Int("sl", int(wl.DEFAULT_LOG_LEVEL), "Set syslog log level.")
+    dryRun := flag.Bool("n", false, "Dry run: only log the file system operations and syncer commands which would be run.")
+    flag.BoolVar(dryRun, "dry-run", false, "Same as -n.")
+    lockWait := flag.Duration("w", 0, "Maximum time to wait for the lock file, e.g. \"30s\". Waits forever by default.")
+    flag.DurationVar(lockWait, "wait", 0, "Same as -w.")
     flag.Usage = func() {
-        fmt.Fprintf(os.Stderr, "Usage of %s %s:\n", os.Args[0], "[options] <command>")
+        fmt.Fprintf(os.Stderr, "Usage of %s %s:\n", os.Args[0], "[options] <command> [path...]")
         fmt.Fprintf(os.Stderr, "  Commands:\n")
         fmt.Fprintf(os.Stderr, "   initsync\tReplaces sync directories with symlinks to tmpfs while syncing orginal content there.\n")
         fmt.Fprintf(os.Stderr, "   sync\t\tSyncs content from tmpfs to the backup.\n")
@@ -705,6 +1179,14 @@ func runMain() int {
         fmt.Fprintf(os.Stderr, "   start\tAlias for running check and initsync.\n")
         fmt.Fprintf(os.Stderr, "   stop\t\tAlias for running sync and unsync.\n")
         fmt.Fprintf(os.Stderr, "   info\t\tGives information about current sync status.\n")
+        fmt.Fprintf(os.Stderr, "   checkconfig\tChecks the config files and reports all problems found.\n")
+        fmt.Fprintf(os.Stderr, "   config\tGets or sets options: get OPTION, set OPTION VALUE, add-path PATH, remove-path [--unsync] PATH.\n")
+        fmt.Fprintf(os.Stderr, "   lock\t\tShows which process holds the lock file: lock status.\n")
+        fmt.Fprintf(os.Stderr, "   daemon\tRuns start, syncs every SYNC_INTERVAL and runs stop on SIGINT or SIGTERM.\n")
+        fmt.Fprintf(os.Stderr, "   snapshot\tArchives the disk copies of sync directories to SNAPSHOT_DIR.\n")
+        fmt.Fprintf(os.Stderr, "   repair\tFinds out the condition of every sync path and fixes inconsistent ones: repair [--dry-run] [--remove-legacy-lock].\n")
+        fmt.Fprintf(os.Stderr, "   restore\tReplaces sync directories with a backup generation: restore [--unsync] --generation GEN.\n")
+        fmt.Fprintf(os.Stderr, "  Commands info, initsync, sync, unsync, snapshot and restore act only on given sync paths, if any.\n")
         fmt.Fprintf(os.Stderr, "  Options:\n")
         flag.PrintDefaults()
         if *verbose {
@@ -719,6 +1201,26 @@ func runMain() int {
     LOG.SetSyslogPriority(syslog.Priority(*syslogLogLevel))
     if *verbose {
         LOG.SetConsoleLogPriority(syslog.LOG_DEBUG)
+    } else if *dryRun {
+        // The planned operations are logged with info priority
+        LOG.SetConsoleLogPriority(syslog.LOG_INFO)
+    }
+    if *dryRun {
+        switch flag.Arg(0) {
+        case "initsync", "sync", "unsync", "start", "stop", "repair":
+        default:
+            LOG.Err("Command %s does not support dry run.", flag.Arg(0))
+            return 1
+        }
+    }
+
+    // The config check reports all problems instead of stopping at the first
+    // one, so it reads the config file itself.
+    if flag.Arg(0) == "checkconfig" {
+        return checkConfig(*configFilePath)
+    }
+    if flag.Arg(0) == "config" {
+        return configCommand(*configFilePath, flag.Args()[1:], *lockWait)
     }
 
     // Read config file
@@ -731,6 +1233,9 @@ func runMain() int {
     if *verbose {
         copts.Print()
     }
+    if *dryRun {
+        copts.setDryRun()
+    }
 
     // For now do not allow synchronous calls at all.
     // Check that lock files base path
@@ -739,59 +1244,142 @@ func runMain() int {
         return 1
     }
 
-    // Locking to prevent synchronous operations
-    for ok, err := getLock(copts.lockfile); !ok; ok, err = getLock(copts.lockfile) {
-        if err != nil {
+    // Catch SIGINT and SIGTERM so that sync paths are left in a consistent
+    // state and the lock file is released.
+    intr := NewInterrupt()
+    defer intr.Stop()
+
+    // The lock status is shown without taking the lock
+    if flag.Arg(0) == "lock" {
+        return lockCommand(copts.lockfile, flag.Args()[1:])
+    }
+
+    // The daemon takes the lock only for the duration of each operation so
+    // that other commands, like info, can be run while it's running.
+    if flag.Arg(0) == "daemon" {
+        return daemon(copts, *lockWait, intr)
+    }
+    cancel := intr.Next()
+
+    // The restore and repair commands have options of their own
+    args := flag.Args()[1:]
+    var generation string
+    var unsyncPath bool
+    var removeLegacy bool
+    if flag.Arg(0) == "restore" {
+        flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+        flags.StringVar(&generation, "generation", "", "Generation to restore, its name or number (1 is the newest).")
+        flags.BoolVar(&unsyncPath, "unsync", false, "Sync back and unsync synced paths before restoring them.")
+        if err = flags.Parse(args); err != nil {
+            return 1
+        }
+        if generation == "" {
+            LOG.Err("No generation given for restore, use --generation.")
+            return 1
+        }
+        args = flags.Args()
+    }
+    if flag.Arg(0) == "repair" {
+        flags := flag.NewFlagSet("repair", flag.ContinueOnError)
+        flags.BoolVar(dryRun, "dry-run", *dryRun, "Only print what would be done.")
+        flags.BoolVar(&removeLegacy, "remove-legacy-lock", false, "Remove a lock directory left behind by an earlier version.")
+        if err = flags.Parse(args); err != nil {
+            return 1
+        }
+        args = flags.Args()
+    }
+
+    // A lock directory of an earlier version blocks every command until the
+    // earlier version removes it. One left behind is removed only when asked
+    // for, as an earlier version still running would not notice the flock lock.
+    if removeLegacy && !*dryRun {
+        if err = removeLegacyLock(copts.lockfile); err != nil {
             LOG.Err("Lock file: %s", err)
             return 1
         }
-        // TODO: specify max wait time
-        // TODO: use inotify when go provides an interface for it
-        time.Sleep(time.Millisecond * 100)
     }
-    // If os.Exit() is called remember to remove the lock file, manually.
-    defer releaseLock(copts.lockfile)
+
+    // Locking to prevent synchronous operations. The kernel releases the
+    // lock if the process dies.
+    lock, err := acquireLock(copts.lockfile, *lockWait, cancel)
+    if err != nil {
+        LOG.Err("Lock file: %s", err)
+        return 1
+    }
+    defer lock.release()
+
+    // Expand glob patterns in sync paths. Commands which initialize sync paths
+    // record the expansion and others use the recorded one.
+    record := flag.Arg(0) == "start" || flag.Arg(0) == "initsync"
+    if err = expandSyncPaths(copts, record); err != nil {
+        LOG.Err("Sync path patterns: %s", err)
+        return 1
+    }
+
+    // Commands which act on sync paths can be given a subset of them
+    syncPaths := copts.syncPaths
+    if len(args) > 0 {
+        switch flag.Arg(0) {
+        case "info", "initsync", "sync", "unsync", "snapshot", "restore":
+            if syncPaths, err = selectSyncPaths(copts, args); err != nil {
+                LOG.Err("%s", err)
+                return 1
+            }
+        default:
+            LOG.Err("Command %s does not take paths.", flag.Arg(0))
+            return 1
+        }
+    }
 
     switch flag.Arg(0) {
     case "info":
-        info(copts)
+        info(copts, &syncPaths)
     case "check":
-        checkAndFix(copts.tmpfsPath, &copts.syncPaths)
+        checkAndFix(copts, &copts.syncPaths)
+    case "repair":
+        if ok := repair(copts, *dryRun, cancel); !ok {
+            return 1
+        }
     case "initsync":
-        if err := initSync(copts.tmpfsPath, &copts.syncPaths, copts.syncerBin); err != nil {
-            LOG.Err(err.Error())
+        if err := initSync(copts, &syncPaths, cancel); err != nil {
+            LOG.Err("%s", err)
             return 1
         }
     case "sync":
-        sync(copts.tmpfsPath, &copts.syncPaths, copts.syncerBin)
+        sync(copts, &syncPaths, cancel)
     case "unsync":
-        unsync(copts.tmpfsPath, &copts.syncPaths, true)
-    case "start":
-        // Check that given TMPFS path does not contain any extra paths which
-        // are not in syncPaths and might not be synced back
-        if ok := checkVolatile(copts.tmpfsPath, &copts.syncPaths); !ok {
+        // Without given paths, paths removed from WHATTOSYNC are synced back
+        // and restored too.
+        if len(args) == 0 {
+            orphans := orphanPaths(copts, &copts.syncPaths)
+            sync(copts, &orphans, cancel)
+            syncPaths = append(append([]string(nil), syncPaths...), orphans...)
+        }
+        unsync(copts, &syncPaths, true, cancel)
+    case "snapshot":
+        if ok := snapshot(copts, &syncPaths, cancel); !ok {
             return 1
         }
-        checkAndFix(copts.tmpfsPath, &copts.syncPaths)
-        if err := initSync(copts.tmpfsPath, &copts.syncPaths, copts.syncerBin); err != nil {
-            LOG.Err(err.Error())
+    case "restore":
+        if ok := restore(copts, &syncPaths, generation, unsyncPath, cancel); !ok {
+            return 1
+        }
+    case "start":
+        if ok := start(copts, cancel); !ok {
             return 1
         }
     case "stop":
-        sync(copts.tmpfsPath, &copts.syncPaths, copts.syncerBin)
-        unsync(copts.tmpfsPath, &copts.syncPaths, true)
-        // If not all volatile paths were synced back issue a warning
-        // XXX: checkVolatile actually warns only about volatile paths not in
-        // syncPaths, so if unsync left something from syncPaths unsynced then
-        // checkVolatile would not notice a problem.
-        if ok := checkVolatile(copts.tmpfsPath, &copts.syncPaths); !ok {
+        if ok := stop(copts, cancel); !ok {
             return 1
         }
     default:
-        LOG.Err("Invalid command provided", err)
+        LOG.Err("Invalid command provided: %s", flag.Arg(0))
         flag.Usage()
         return 1
     }
+    if interrupted(cancel) {
+        return 1
+    }
     return 0
 }
 
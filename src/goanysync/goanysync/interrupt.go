@@ -0,0 +1,90 @@
+// Copyright (C) 2012 Esa Määttä <esa.maatta@iki.fi>
+// This file is released under the GNU GPL, version 3 or a later revision.
+// For further details see the COPYING file.
+
+package main
+
+import (
+    "bytes"
+    "errors"
+    "os"
+    "os/exec"
+    "os/signal"
+    "syscall"
+)
+
+// errInterrupted is returned when an operation was cancelled by a signal.
+var errInterrupted = errors.New("Interrupted by a signal.")
+
+// Interrupt catches SIGINT and SIGTERM so that the program can finish or roll
+// back the sync path it's working on before exiting, instead of being killed
+// in the middle of it.
+type Interrupt struct {
+    sigc chan os.Signal
+}
+
+// NewInterrupt starts catching SIGINT and SIGTERM and returns pointer to the
+// created Interrupt.
+func NewInterrupt() *Interrupt { // {{{
+    i := &Interrupt{make(chan os.Signal, 1)}
+    signal.Notify(i.sigc, syscall.SIGINT, syscall.SIGTERM)
+    return i
+}   // }}}
+
+// Stop restores the default signal behaviour.
+func (self *Interrupt) Stop() { // {{{
+    signal.Stop(self.sigc)
+}   // }}}
+
+// Next returns a channel which is closed when the next signal is received.
+// Only one channel returned by Next should be waited for at a time.
+func (self *Interrupt) Next() <-chan struct{} { // {{{
+    cancel := make(chan struct{})
+    go func() {
+        sig := <-self.sigc
+        LOG.Warn("Received %s, finishing the current sync path before exiting.", sig)
+        close(cancel)
+    }()
+    return cancel
+}   // }}}
+
+// interrupted checks whether given cancel channel has been closed. A nil
+// channel is never closed.
+func interrupted(cancel <-chan struct{}) bool { // {{{
+    select {
+    case <-cancel:
+        return true
+    default:
+        return false
+    }
+}   // }}}
+
+// runCommand runs given command and returns its combined output. The command
+// is run in its own process group so that a SIGINT from the terminal doesn't
+// reach it directly. If cancel is closed before the command completes, the
+// command is killed and errInterrupted is returned.
+func runCommand(cmd *exec.Cmd, cancel <-chan struct{}) ([]byte, error) { // {{{
+    var output bytes.Buffer
+    cmd.Stdout = &output
+    cmd.Stderr = &output
+    cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+    if err := cmd.Start(); err != nil {
+        return nil, err
+    }
+
+    done := make(chan error, 1)
+    go func() {
+        done <- cmd.Wait()
+    }()
+
+    select {
+    case err := <-done:
+        return output.Bytes(), err
+    case <-cancel:
+        cmd.Process.Kill()
+        <-done
+        return output.Bytes(), errInterrupted
+    }
+}   // }}}
+
+// vim: set sts=4 ts=4 sw=4 et foldmethod=marker:
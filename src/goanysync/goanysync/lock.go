@@ -0,0 +1,236 @@
+// Copyright (C) 2012 Esa Määttä <esa.maatta@iki.fi>
+// This file is released under the GNU GPL, version 3 or a later revision.
+// For further details see the COPYING file.
+
+package main
+
+import (
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "strconv"
+    "strings"
+    "syscall"
+    "time"
+)
+
+// LOCK_POLL_INTERVAL is how often a lock held by another process is tried
+// again.
+// TODO: use inotify when go provides an interface for it
+const LOCK_POLL_INTERVAL = 100 * time.Millisecond
+
+// LockOwner is the process which holds the lock. It's written to the lock
+// file, which is emptied when the lock is released, so an owner left in the
+// file of a free lock is an owner which crashed.
+type LockOwner struct {
+    pid     int
+    command string
+    started time.Time
+}
+
+// running checks whether the owner process is still running.
+func (self LockOwner) running() bool { // {{{
+    err := syscall.Kill(self.pid, 0)
+    return err == nil || err == syscall.EPERM
+}   // }}}
+
+func (self LockOwner) String() string { // {{{
+    s := fmt.Sprintf("PID %d (%s), started %s", self.pid, self.command, self.started.Format(STATE_TIME_FORMAT))
+    if !self.running() {
+        s += ", not running"
+    }
+    return s
+}   // }}}
+
+// readLockOwner reads the owner from the lock file. Returns nil for an empty
+// lock file.
+func readLockOwner(f *os.File) (*LockOwner, error) { // {{{
+    if _, err := f.Seek(0, 0); err != nil {
+        return nil, err
+    }
+    data, err := io.ReadAll(f)
+    if err != nil || len(data) == 0 {
+        return nil, err
+    }
+    // The lock file has lines: PID, start time and command
+    lines := strings.SplitN(strings.TrimRight(string(data), "\n"), "\n", 3)
+    if len(lines) != 3 {
+        return nil, errors.New("Invalid lock file content.")
+    }
+    owner := &LockOwner{command: lines[2]}
+    if owner.pid, err = strconv.Atoi(lines[0]); err != nil {
+        return nil, errors.New("Invalid PID in lock file: " + lines[0])
+    }
+    if owner.started, err = time.Parse(time.RFC3339, lines[1]); err != nil {
+        return nil, errors.New("Invalid start time in lock file: " + lines[1])
+    }
+    return owner, nil
+}   // }}}
+
+// Lock is an acquired lock file.
+type Lock struct {
+    file *os.File
+}
+
+// isLegacyLock checks whether the lock is a lock directory of an earlier
+// version, which used a directory as the lock. The directory is removed by
+// the earlier version when it releases the lock.
+func isLegacyLock(lockName string) bool { // {{{
+    fi, err := os.Lstat(lockName)
+    return err == nil && fi.IsDir()
+}   // }}}
+
+// removeLegacyLock removes the lock directory of an earlier version, if it
+// exists. It must only be done when no earlier version is running, as an
+// earlier version does not know about the flock lock.
+func removeLegacyLock(lockName string) error { // {{{
+    if !isLegacyLock(lockName) {
+        return nil
+    }
+    LOG.Warn("Removing the lock directory of an earlier version, which must only be done when no earlier version of goanysync is running: %s", lockName)
+    return os.Remove(lockName)
+}   // }}}
+
+// tryLock tries to acquire the lock without waiting. Returns nil lock if
+// another process holds it, or if there is a lock directory of an earlier
+// version.
+func tryLock(lockName string) (*Lock, error) { // {{{
+    if isLegacyLock(lockName) {
+        return nil, nil
+    }
+    f, err := os.OpenFile(lockName, os.O_RDWR|os.O_CREATE, 0644)
+    if err != nil {
+        return nil, err
+    }
+    if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+        f.Close()
+        if err == syscall.EWOULDBLOCK {
+            return nil, nil
+        }
+        return nil, err
+    }
+
+    // The kernel releases the lock of a crashed process, but its owner is
+    // left in the file.
+    if owner, err := readLockOwner(f); err != nil {
+        LOG.Warn("Lock file: %s", err)
+    } else if owner != nil {
+        LOG.Warn("Took over a stale lock of %s.", owner)
+    }
+
+    content := fmt.Sprintf("%d\n%s\n%s\n", os.Getpid(), time.Now().Format(time.RFC3339), strings.Join(os.Args, " "))
+    if err = f.Truncate(0); err == nil {
+        if _, err = f.WriteAt([]byte(content), 0); err == nil {
+            err = f.Sync()
+        }
+    }
+    if err != nil {
+        f.Close()
+        return nil, err
+    }
+    return &Lock{f}, nil
+}   // }}}
+
+// acquireLock waits until the lock can be acquired. Waiting is stopped with
+// errInterrupted if cancel is closed, and with an error after given wait
+// time. Zero wait time waits forever.
+func acquireLock(lockName string, wait time.Duration, cancel <-chan struct{}) (*Lock, error) { // {{{
+    deadline := time.Now().Add(wait)
+    for waiting := false; ; waiting = true {
+        if lock, err := tryLock(lockName); lock != nil || err != nil {
+            return lock, err
+        }
+        if interrupted(cancel) {
+            return nil, errInterrupted
+        }
+        if wait > 0 && time.Now().After(deadline) {
+            return nil, fmt.Errorf("Timed out after %s waiting for the lock held by %s.", wait, lockHolder(lockName))
+        }
+        if !waiting && isLegacyLock(lockName) {
+            LOG.Warn("Waiting for %s. If no earlier version is running, remove the directory with repair --remove-legacy-lock.", lockHolder(lockName))
+        } else if !waiting {
+            LOG.Info("Waiting for the lock held by %s.", lockHolder(lockName))
+        }
+        time.Sleep(LOCK_POLL_INTERVAL)
+    }
+}   // }}}
+
+// release empties the lock file and releases the lock.
+func (self *Lock) release() { // {{{
+    if err := self.file.Truncate(0); err != nil {
+        LOG.Err("releaseLock: %s", err)
+    }
+    if err := syscall.Flock(int(self.file.Fd()), syscall.LOCK_UN); err != nil {
+        LOG.Err("releaseLock: %s", err)
+    }
+    self.file.Close()
+}   // }}}
+
+// lockHolder returns a description of the owner of a held lock.
+func lockHolder(lockName string) string { // {{{
+    if isLegacyLock(lockName) {
+        return "an earlier version of goanysync, lock directory " + lockName
+    }
+    f, err := os.Open(lockName)
+    if err != nil {
+        return "an unknown process"
+    }
+    defer f.Close()
+    if owner, err := readLockOwner(f); err == nil && owner != nil {
+        return owner.String()
+    }
+    return "an unknown process"
+}   // }}}
+
+// lockCommand runs the lock subcommand given in args. "status" prints whether
+// the lock is held and by which process. Returns the exit status of the
+// command.
+func lockCommand(lockName string, args []string) int { // {{{
+    if len(args) != 1 || args[0] != "status" {
+        LOG.Err("lock: Usage: lock status")
+        return 1
+    }
+    if !exists(lockName) {
+        fmt.Printf("Not locked.\n")
+        return 0
+    }
+    f, err := os.Open(lockName)
+    if err != nil {
+        LOG.Err("lock: %s", err)
+        return 1
+    }
+    defer f.Close()
+    if fi, err := f.Stat(); err == nil && fi.IsDir() {
+        fmt.Printf("Locked with a lock directory of an earlier version, which removes it when it's done.\n")
+        fmt.Printf("If no earlier version of goanysync is running, remove the directory with repair --remove-legacy-lock.\n")
+        return 0
+    }
+
+    owner, err := readLockOwner(f)
+    if err != nil {
+        LOG.Err("lock: %s", err)
+        return 1
+    }
+    // The lock is held if it can't be acquired
+    held := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB) == syscall.EWOULDBLOCK
+    if !held {
+        syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+    }
+    switch {
+    case held && owner != nil:
+        fmt.Printf("Locked by %s.\n", owner)
+        if !owner.running() {
+            fmt.Printf("The owner is not running, the lock is held by a process which inherited the lock file.\n")
+        }
+    case held:
+        fmt.Printf("Locked by an unknown process.\n")
+    case owner != nil:
+        fmt.Printf("Not locked. The lock was not released by %s, which probably crashed.\n", owner)
+    default:
+        fmt.Printf("Not locked.\n")
+    }
+    return 0
+}   // }}}
+
+// vim: set sts=4 ts=4 sw=4 et foldmethod=marker:
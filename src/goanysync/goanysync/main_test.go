@@ -0,0 +1,25 @@
+// Copyright (C) 2012 Esa Määttä <esa.maatta@iki.fi>
+// This file is released under the GNU GPL, version 3 or a later revision.
+// For further details see the COPYING file.
+
+package main
+
+import (
+    "fmt"
+    "log/syslog"
+    "os"
+    "testing"
+
+    wl "goanysync/log"
+)
+
+func TestMain(m *testing.M) {
+    var err error
+    if LOG, err = wl.New("goanysync", syslog.Priority(0), syslog.Priority(0)); err != nil {
+        fmt.Fprintln(os.Stderr, "Failed to initialize logging:", err)
+        os.Exit(1)
+    }
+    os.Exit(m.Run())
+}
+
+// vim: set sts=4 ts=4 sw=4 et foldmethod=marker:
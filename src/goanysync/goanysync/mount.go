@@ -0,0 +1,248 @@
+// Copyright (C) 2012 Esa Määttä <esa.maatta@iki.fi>
+// This file is released under the GNU GPL, version 3 or a later revision.
+// For further details see the COPYING file.
+
+package main
+
+import (
+    "bufio"
+    "errors"
+    "fmt"
+    "os"
+    "path"
+    "strconv"
+    "strings"
+    "syscall"
+)
+
+// Modes of replacing a sync path with its volatile path.
+const (
+    // The sync path is renamed and replaced with a symlink
+    MODE_SYMLINK = "symlink"
+    // The volatile path is bind-mounted over the sync path
+    MODE_BIND = "bind"
+    // An overlay of the sync path and the volatile path is mounted over the
+    // sync path
+    MODE_OVERLAY = "overlay"
+)
+
+// MOUNTS_POSTFIX is appended to the lock file path to get the directory under
+// which the disk copies of bind-mounted sync paths are mounted.
+const MOUNTS_POSTFIX = ".mounts"
+
+// MOUNTINFO lists the mount points of the process.
+const MOUNTINFO = "/proc/self/mountinfo"
+
+// readMode reads MODE option from given option data. If the option is not in
+// data, given default is returned.
+func readMode(data map[string]*string, def string) (mode string, err error) { // {{{
+    mode = def
+    if v, ok := data["MODE"]; ok {
+        switch mode = strings.TrimSpace(*v); mode {
+        case MODE_SYMLINK, MODE_BIND, MODE_OVERLAY:
+        default:
+            err = errors.New("Invalid MODE: " + *v)
+        }
+    }
+    return
+}   // }}}
+
+// getMountsPath returns the directory under which the disk copies of
+// bind-mounted sync paths are mounted.
+func getMountsPath(lockfile string) string { // {{{
+    return lockfile + MOUNTS_POSTFIX
+}   // }}}
+
+// getDiskMountPath returns the path where the disk copy of given bind-mounted
+// sync path is mounted.
+func getDiskMountPath(lockfile string, syncSource string) string { // {{{
+    return path.Join(getMountsPath(lockfile), path.Clean(syncSource))
+}   // }}}
+
+// isMountPoint checks whether given path is a mount point.
+func isMountPoint(p string) bool { // {{{
+    return mountFsType(p) != ""
+}   // }}}
+
+// mountEntry is a mount listed in MOUNTINFO.
+type mountEntry struct {
+    point  string
+    fsType string
+    source string
+}
+
+// readMountInfo returns the mounts of the process in mount order, so later
+// mounts are on top of the earlier ones.
+func readMountInfo() (mounts []mountEntry, err error) { // {{{
+    f, err := os.Open(MOUNTINFO)
+    if err != nil {
+        return
+    }
+    defer f.Close()
+
+    scanner := bufio.NewScanner(f)
+    for scanner.Scan() {
+        // The fifth field is the mount point, with spaces and other special
+        // characters escaped as octal "\ooo". The file system type and the
+        // mount source follow the optional fields, which end with a "-"
+        // field.
+        fields := strings.Fields(scanner.Text())
+        if len(fields) < 5 {
+            continue
+        }
+        m := mountEntry{point: unescapeMountPath(fields[4])}
+        for i := 5; i < len(fields)-2; i++ {
+            if fields[i] == "-" {
+                m.fsType, m.source = fields[i+1], unescapeMountPath(fields[i+2])
+                break
+            }
+        }
+        mounts = append(mounts, m)
+    }
+    return mounts, scanner.Err()
+}   // }}}
+
+// mountFsType returns the file system type of the topmost mount at given
+// path, or an empty string if the path is not a mount point.
+func mountFsType(p string) (fsType string) { // {{{
+    mounts, _ := readMountInfo()
+    p = path.Clean(p)
+    for _, m := range mounts {
+        if m.point == p {
+            fsType = m.fsType
+        }
+    }
+    return
+}   // }}}
+
+// findMount returns the topmost mount containing given absolute path, which
+// must not contain symlinks.
+func findMount(p string) (mount mountEntry, err error) { // {{{
+    mounts, err := readMountInfo()
+    if err != nil {
+        return
+    }
+    p = path.Clean(p)
+    for _, m := range mounts {
+        if (m.point == p || m.point == "/" || strings.HasPrefix(p, m.point+"/")) && len(m.point) >= len(mount.point) {
+            mount = m
+        }
+    }
+    if mount.point == "" {
+        err = errors.New("No mount found for: " + p)
+    }
+    return
+}   // }}}
+
+// unescapeMountPath replaces octal escapes "\ooo" in a mountinfo path.
+func unescapeMountPath(p string) string { // {{{
+    var unescaped []byte
+    for i := 0; i < len(p); i++ {
+        if p[i] == '\\' && i+3 < len(p) {
+            if c, err := strconv.ParseUint(p[i+1:i+4], 8, 8); err == nil {
+                unescaped = append(unescaped, byte(c))
+                i += 3
+                continue
+            }
+        }
+        unescaped = append(unescaped, p[i])
+    }
+    return string(unescaped)
+}   // }}}
+
+// isBound checks whether given sync path is bind-mounted, which is the case
+// when its disk copy is mounted.
+func isBound(syncSource string, lockfile string) bool { // {{{
+    return isMountPoint(getDiskMountPath(lockfile, syncSource))
+}   // }}}
+
+// mountPrivate mounts source to target and makes the mount private, so that
+// it's not propagated to other mount namespaces.
+func mountPrivate(source string, target string, fsType string, flags uintptr, data string) error { // {{{
+    if err := syscall.Mount(source, target, fsType, flags, data); err != nil {
+        return fmt.Errorf("Mounting '%s' to '%s' failed: %s", source, target, err)
+    }
+    if err := syscall.Mount("", target, "", syscall.MS_PRIVATE, ""); err != nil {
+        if uerr := syscall.Unmount(target, 0); uerr != nil {
+            LOG.Err("Unmounting '%s' failed: %s", target, uerr)
+        }
+        return fmt.Errorf("Making mount '%s' private failed: %s", target, err)
+    }
+    return nil
+}   // }}}
+
+// mountDiskCopy bind-mounts sync path s to its disk mount path, so that the
+// disk copy of s stays reachable when something is mounted over s.
+func mountDiskCopy(s string, lockfile string) (diskPath string, err error) { // {{{
+    if os.Geteuid() != 0 {
+        return "", errors.New("Bind and overlay modes require root privileges.")
+    }
+    diskPath = getDiskMountPath(lockfile, s)
+    if err = os.MkdirAll(diskPath, 0700); err != nil {
+        return
+    }
+    if err = mountPrivate(s, diskPath, "", syscall.MS_BIND, ""); err != nil {
+        removeDiskMountPath(lockfile, s)
+    }
+    return
+}   // }}}
+
+// unmountDiskCopy undoes mountDiskCopy after a failed initialization of sync
+// path s. Errors are logged with given prefix.
+func unmountDiskCopy(s string, lockfile string, prefix string) { // {{{
+    diskPath := getDiskMountPath(lockfile, s)
+    if err := syscall.Unmount(diskPath, 0); err != nil {
+        LOG.Err("%s: Unmounting '%s' failed: %s", prefix, diskPath, err)
+        return
+    }
+    removeDiskMountPath(lockfile, s)
+}   // }}}
+
+// initBind mounts the disk copy of sync path s to its disk mount path, copies
+// it to volatilePath with given syncer and bind-mounts volatilePath over s.
+func initBind(s string, volatilePath string, lockfile string, syncer Syncer, cancel <-chan struct{}) (err error) { // {{{
+    diskPath, err := mountDiskCopy(s, lockfile)
+    if err != nil {
+        return
+    }
+    // Restore the original state on errors
+    defer func() {
+        if err != nil {
+            unmountDiskCopy(s, lockfile, "initSync (bind)")
+        }
+    }()
+
+    if err = syncer.Sync(diskPath, volatilePath, cancel); err != nil {
+        return
+    }
+    return mountPrivate(volatilePath, s, "", syscall.MS_BIND, "")
+}   // }}}
+
+// unbind unmounts the volatile path or the overlay from sync path s and the
+// disk copy of s from its disk mount path. After this the disk copy is at s again.
+func unbind(s string, lockfile string) error { // {{{
+    if isMountPoint(s) {
+        if err := syscall.Unmount(s, 0); err != nil {
+            return fmt.Errorf("Unmounting '%s' failed: %s", s, err)
+        }
+    }
+    diskPath := getDiskMountPath(lockfile, s)
+    if err := syscall.Unmount(diskPath, 0); err != nil {
+        return fmt.Errorf("Unmounting '%s' failed: %s", diskPath, err)
+    }
+    removeDiskMountPath(lockfile, s)
+    return nil
+}   // }}}
+
+// removeDiskMountPath removes the disk mount path of given sync path and its
+// empty parents until the mounts dir.
+func removeDiskMountPath(lockfile string, syncSource string) { // {{{
+    mounts := getMountsPath(lockfile)
+    for p := getDiskMountPath(lockfile, syncSource); p != path.Dir(mounts); p = path.Dir(p) {
+        if err := os.Remove(p); err != nil {
+            break
+        }
+    }
+}   // }}}
+
+// vim: set sts=4 ts=4 sw=4 et foldmethod=marker:
@@ -0,0 +1,192 @@
+// Copyright (C) 2012 Esa Määttä <esa.maatta@iki.fi>
+// This file is released under the GNU GPL, version 3 or a later revision.
+// For further details see the COPYING file.
+
+package main
+
+import (
+    "os"
+    "path"
+    "path/filepath"
+    "strings"
+    "syscall"
+)
+
+const (
+    // OVERLAY_WORK_BASE is the directory under TMPFS where the overlay work
+    // dirs are. It's outside of the volatile base dirs, so work dirs are not
+    // taken as volatile paths.
+    OVERLAY_WORK_BASE = "goanysync-work"
+    // OVERLAY_OPAQUE_XATTR marks a directory of the upper layer which hides
+    // the contents of the same directory in the lower layer.
+    OVERLAY_OPAQUE_XATTR = "trusted.overlay.opaque"
+)
+
+// getOverlayWorkPath returns the overlay work dir of given sync path.
+func getOverlayWorkPath(tmpfs string, syncSource string) string { // {{{
+    return path.Join(tmpfs, OVERLAY_WORK_BASE, path.Clean(syncSource))
+}   // }}}
+
+// isOverlay checks whether an overlay is mounted over given sync path.
+func isOverlay(syncSource string, lockfile string) bool { // {{{
+    return isBound(syncSource, lockfile) && mountFsType(syncSource) == "overlay"
+}   // }}}
+
+// initOverlay mounts the disk copy of sync path s to its disk mount path and
+// mounts an overlay over s with the disk copy as the lower layer and
+// volatilePath as the upper layer. Only files which are modified are copied
+// to the upper layer.
+func initOverlay(s string, volatilePath string, tmpfs string, lockfile string) (err error) { // {{{
+    workPath := getOverlayWorkPath(tmpfs, s)
+    if err = os.MkdirAll(workPath, 0700); err != nil {
+        return
+    }
+    diskPath, err := mountDiskCopy(s, lockfile)
+    if err != nil {
+        removeVolatilePath(workPath, tmpfs)
+        return
+    }
+    // Restore the original state on errors
+    defer func() {
+        if err != nil {
+            unmountDiskCopy(s, lockfile, "initSync (overlay)")
+            removeVolatilePath(workPath, tmpfs)
+        }
+    }()
+
+    // Renamed dirs and metadata-only copies would be recorded with xattrs
+    // which mergeUpper does not understand, so they are disabled.
+    escape := strings.NewReplacer(`\`, `\\`, `,`, `\,`, `:`, `\:`).Replace
+    data := "lowerdir=" + escape(diskPath) + ",upperdir=" + escape(volatilePath) + ",workdir=" + escape(workPath) +
+        ",redirect_dir=off,metacopy=off"
+    return mountPrivate("overlay", s, "overlay", 0, data)
+}   // }}}
+
+// isWhiteout checks whether given file of the upper layer is a whiteout,
+// which marks a file removed from the lower layer.
+func isWhiteout(fi os.FileInfo) bool { // {{{
+    st, ok := fi.Sys().(*syscall.Stat_t)
+    return ok && fi.Mode()&os.ModeCharDevice != 0 && st.Rdev == 0
+}   // }}}
+
+// isOpaque checks whether given dir of the upper layer is opaque.
+func isOpaque(p string) bool { // {{{
+    buf := make([]byte, 1)
+    n, err := syscall.Getxattr(p, OVERLAY_OPAQUE_XATTR, buf)
+    return err == nil && n == 1 && buf[0] == 'y'
+}   // }}}
+
+// mergeUpper merges the upper layer of an overlay to its lower layer while the
+// overlay stays mounted. Files of the upper layer replace the ones in the
+// lower layer, whiteouts remove files and opaque dirs remove everything not
+// in the upper layer. Unchanged files are not copied again. Sockets, pipes and
+// devices are skipped.
+func mergeUpper(upper string, lower string, cancel <-chan struct{}) error { // {{{
+    // Attributes of dirs are set after their contents are merged, as merging
+    // changes their modification times.
+    type dir struct {
+        path string
+        fi   os.FileInfo
+    }
+    var dirs []dir
+
+    err := filepath.Walk(upper, func(p string, fi os.FileInfo, err error) error {
+        if err != nil {
+            return err
+        }
+        if interrupted(cancel) {
+            return errInterrupted
+        }
+        rel, err := filepath.Rel(upper, p)
+        if err != nil {
+            return err
+        }
+        d := filepath.Join(lower, rel)
+        dfi, derr := os.Lstat(d)
+
+        // A file replaced with a different type is removed first
+        if derr == nil && rel != "." && (isWhiteout(fi) || dfi.Mode()&os.ModeType != fi.Mode()&os.ModeType) {
+            if err = os.RemoveAll(d); err != nil {
+                return err
+            }
+            derr = os.ErrNotExist
+        }
+
+        switch mode := fi.Mode(); {
+        case isWhiteout(fi):
+        case mode.IsDir():
+            if derr != nil {
+                if err = os.Mkdir(d, 0700); err != nil {
+                    return err
+                }
+            } else if isOpaque(p) {
+                if err = removeExtra(p, d); err != nil {
+                    return err
+                }
+            }
+            dirs = append(dirs, dir{d, fi})
+        case mode&os.ModeSymlink != 0:
+            var target string
+            if target, err = os.Readlink(p); err != nil {
+                return err
+            }
+            if derr == nil {
+                if dtarget, _ := os.Readlink(d); dtarget == target {
+                    return copyOwner(d, fi)
+                }
+                if err = os.Remove(d); err != nil {
+                    return err
+                }
+            }
+            if err = os.Symlink(target, d); err != nil {
+                return err
+            }
+            return copyOwner(d, fi)
+        case mode.IsRegular():
+            if derr == nil && unchangedFile(d, fi) {
+                return nil
+            }
+            if err = copyFile(p, d); err != nil {
+                return err
+            }
+            return copyAttributes(d, fi)
+        default:
+            LOG.Debug("Skipping special file: %s", p)
+        }
+        return nil
+    })
+    if err != nil {
+        return err
+    }
+
+    for i := len(dirs) - 1; i >= 0; i-- {
+        if err = copyAttributes(dirs[i].path, dirs[i].fi); err != nil {
+            return err
+        }
+    }
+    return nil
+}   // }}}
+
+// removeExtra removes the files of lower layer dir lower which are not in
+// upper layer dir upper.
+func removeExtra(upper string, lower string) error { // {{{
+    f, err := os.Open(lower)
+    if err != nil {
+        return err
+    }
+    names, err := f.Readdirnames(-1)
+    f.Close()
+    if err != nil {
+        return err
+    }
+    for _, n := range names {
+        if _, err := os.Lstat(filepath.Join(upper, n)); os.IsNotExist(err) {
+            if err = os.RemoveAll(filepath.Join(lower, n)); err != nil {
+                return err
+            }
+        }
+    }
+    return nil
+}   // }}}
+
+// vim: set sts=4 ts=4 sw=4 et foldmethod=marker:
@@ -0,0 +1,342 @@
+// Copyright (C) 2012 Esa Määttä <esa.maatta@iki.fi>
+// This file is released under the GNU GPL, version 3 or a later revision.
+// For further details see the COPYING file.
+
+package main
+
+import (
+    "errors"
+    "fmt"
+    "os"
+    "path"
+    "path/filepath"
+    "regexp"
+    "strings"
+    "time"
+)
+
+// Conditions of sync paths found by the repair command.
+const (
+    REPAIR_OK              = "ok"
+    REPAIR_NOT_SYNCED      = "not synced"
+    REPAIR_ORPHAN          = "synced but not in WHATTOSYNC"
+    REPAIR_MISSING         = "sync path does not exist"
+    REPAIR_BACKUP_NO_LINK  = "backup present but no symlink"
+    REPAIR_BROKEN_LINK     = "symlink to missing volatile path, backup present"
+    REPAIR_LOST            = "symlink to missing volatile path, no backup"
+    REPAIR_NO_BACKUP       = "symlink to volatile path, no backup"
+    REPAIR_DIR_AND_BACKUP  = "directory and backup both present"
+    REPAIR_WRONG_OWNER     = "volatile dir owned by wrong user"
+    REPAIR_STALE_MOUNT     = "disk copy mounted without volatile path"
+    REPAIR_STALE_MOUNT_DIR = "leftover disk mount dir"
+    REPAIR_UNKNOWN         = "unknown"
+)
+
+// REPAIR_ASIDE_FORMAT is the time format of the postfix added to a backup
+// which is moved aside.
+const REPAIR_ASIDE_FORMAT = "20060102-150405"
+
+// repairStep is a single action of a repair plan.
+type repairStep struct {
+    desc string
+    do   func() error
+}
+
+// RepairPlan is the condition of a sync path and the steps which fix it.
+type RepairPlan struct {
+    source    string
+    condition string
+    // Explanation printed with the condition, e.g. why a path can't be fixed
+    note  string
+    steps []repairStep
+}
+
+// add appends a step to the plan.
+func (self *RepairPlan) add(desc string, do func() error) { // {{{
+    self.steps = append(self.steps, repairStep{desc, do})
+}   // }}}
+
+// restore adds the steps which put given backup, a backup dir or an archive,
+// in place of the sync path.
+func (self *RepairPlan) restore(backup string) { // {{{
+    s := self.source
+    if backup == getArchivePath(s) {
+        self.add("extract "+backup+" to "+s, func() error { return restoreArchive(s) })
+        return
+    }
+    self.add("rename "+backup+" -> "+s, func() error { return os.Rename(backup, s) })
+}   // }}}
+
+// volatileOwner returns the user and group id of a volatile path, which are
+// part of the name of its volatile base dir.
+func volatileOwner(volatilePath string, tmpfs string) (uid, gid uint, err error) { // {{{
+    rel := strings.TrimPrefix(volatilePath, path.Clean(tmpfs)+"/")
+    _, err = fmt.Sscanf(strings.SplitN(rel, "/", 2)[0], VOLATILE_BASE, &uid, &gid)
+    return
+}   // }}}
+
+// volatileSources returns the sync paths which have a volatile path under
+// TMPFS and either a backup or a symlink pointing to the volatile path.
+func volatileSources(tmpfs string) (sources []string) { // {{{
+    if !exists(tmpfs) {
+        return
+    }
+    vbpRE := regexp.MustCompile(getVolatileBasePathRe(tmpfs))
+    filepath.Walk(tmpfs, func(p string, fi os.FileInfo, err error) error {
+        if err != nil || !fi.IsDir() {
+            return nil
+        }
+        loc := vbpRE.FindStringIndex(p)
+        if loc == nil || loc[1] == len(p) {
+            return nil
+        }
+        s := p[loc[1]:]
+        target, _ := os.Readlink(s)
+        if target == p || exists(getBackupPath(s)) || exists(getArchivePath(s)) {
+            sources = append(sources, s)
+            return filepath.SkipDir
+        }
+        return nil
+    })
+    return
+}   // }}}
+
+// repairSources returns the sync paths, the paths in the state file and the
+// paths found from TMPFS, each once.
+func repairSources(copts *ConfigOptions, st *State) (sources []string) { // {{{
+    found := make(map[string]bool)
+    add := func(s string) {
+        if s = path.Clean(s); !found[s] {
+            found[s] = true
+            sources = append(sources, s)
+        }
+    }
+    for _, s := range copts.syncPaths {
+        add(s)
+    }
+    for _, ps := range st.extra(&copts.syncPaths) {
+        add(ps.Source)
+    }
+    for _, s := range volatileSources(copts.tmpfsPath) {
+        add(s)
+    }
+    return
+}   // }}}
+
+// classifyPath finds out the condition of sync path s and makes a plan to fix
+// it.
+func classifyPath(copts *ConfigOptions, st *State, s string) *RepairPlan { // {{{
+    plan := &RepairPlan{source: s, condition: REPAIR_OK}
+    ps := st.find(s)
+    tmpfs := copts.tmpfsPath
+    if ps != nil {
+        tmpfs = ps.Tmpfs
+    }
+    _, backupPath, volatilePathRe := pathNameGen(s, tmpfs, 0, 0)
+    diskPath := getDiskMountPath(copts.lockfile, s)
+
+    // The persistent copy is either the backup dir or the archive
+    backup := ""
+    if exists(backupPath) {
+        backup = backupPath
+    } else if exists(getArchivePath(s)) {
+        backup = getArchivePath(s)
+    }
+    // A path which is put back in place is removed from the state file
+    forget := func() {
+        if ps != nil {
+            plan.add("remove "+s+" from the state file", func() error {
+                recordUnsync(copts, s)
+                return nil
+            })
+        }
+    }
+
+    // Bind and overlay modes leave the sync path itself in place
+    switch bound := st.bound(s, copts.lockfile); {
+    case bound && isMountPoint(s):
+        return plan
+    case bound:
+        plan.condition = REPAIR_STALE_MOUNT
+        plan.add("unmount "+diskPath, func() error { return unbind(s, copts.lockfile) })
+        if workPath := getOverlayWorkPath(tmpfs, s); exists(workPath) {
+            plan.add("remove "+workPath, func() error {
+                removeVolatilePath(workPath, tmpfs)
+                return nil
+            })
+        }
+        forget()
+        return plan
+    case exists(diskPath):
+        plan.condition = REPAIR_STALE_MOUNT_DIR
+        plan.add("remove "+diskPath, func() error {
+            removeDiskMountPath(copts.lockfile, s)
+            return nil
+        })
+        forget()
+        return plan
+    }
+
+    fi, err := os.Lstat(s)
+    switch {
+    case os.IsNotExist(err) && backup == "":
+        plan.condition = REPAIR_MISSING
+        plan.note = "Nothing to restore it from."
+        forget()
+    case os.IsNotExist(err):
+        plan.condition = REPAIR_BACKUP_NO_LINK
+        plan.restore(backup)
+        forget()
+    case err != nil:
+        plan.condition = REPAIR_UNKNOWN
+        plan.note = err.Error()
+    case fi.Mode()&os.ModeSymlink != 0:
+        classifyLink(copts, plan, ps, tmpfs, volatilePathRe, backup, forget)
+    case fi.IsDir() && backup == "":
+        plan.condition = REPAIR_NOT_SYNCED
+        forget()
+    case fi.IsDir():
+        // Which one is newer can't be known, so nothing is removed
+        plan.condition = REPAIR_DIR_AND_BACKUP
+        plan.note = "The directory is kept and the backup is moved aside."
+        aside := backup + "." + time.Now().Format(REPAIR_ASIDE_FORMAT)
+        plan.add("rename "+backup+" -> "+aside, func() error { return os.Rename(backup, aside) })
+        forget()
+    default:
+        plan.condition = REPAIR_UNKNOWN
+        plan.note = "Sync path was not a directory or a symlink."
+    }
+    return plan
+}   // }}}
+
+// classifyLink finds out the condition of a sync path which is a symlink. ps
+// is the state of the path, or nil if it's not recorded.
+func classifyLink(copts *ConfigOptions, plan *RepairPlan, ps *PathState, tmpfs string, volatilePathRe string, backup string, forget func()) { // {{{
+    s := plan.source
+    target, _ := os.Readlink(s)
+    if match, _ := regexp.MatchString(volatilePathRe, target); !match {
+        plan.condition = REPAIR_UNKNOWN
+        plan.note = "Symlink did not point to a volatile path: " + target
+        return
+    }
+    uid, gid, err := volatileOwner(target, tmpfs)
+    if err != nil {
+        plan.condition = REPAIR_UNKNOWN
+        plan.note = fmt.Sprintf("Could not get the owner of volatile path '%s': %s", target, err)
+        return
+    }
+
+    if !exists(target) {
+        plan.add("remove symlink "+s, func() error { return os.Remove(s) })
+        if backup != "" {
+            plan.condition = REPAIR_BROKEN_LINK
+            plan.restore(backup)
+        } else {
+            plan.condition = REPAIR_LOST
+            plan.note = "The volatile copy and the backup are both gone, the content is lost."
+            perm := os.FileMode(0755)
+            if ps != nil {
+                perm, uid, gid = ps.Perm, ps.Uid, ps.Gid
+            }
+            plan.add(fmt.Sprintf("create empty directory %s owned by %d:%d with mode %o", s, uid, gid, perm), func() error {
+                if err := mkdirAll(s, perm, uid, gid); err != nil {
+                    return err
+                }
+                // mkdirAll is subject to the umask
+                return os.Chmod(s, perm)
+            })
+        }
+        forget()
+        return
+    }
+
+    // Without a backup the only copy is in TMPFS, so it's copied to the disk
+    if backup == "" {
+        backupPath := getBackupPath(s)
+        plan.condition = REPAIR_NO_BACKUP
+        plan.add("copy "+target+" to "+backupPath, func() error {
+            fi, err := os.Stat(target)
+            if err != nil {
+                return err
+            }
+            if err = mkdirAll(backupPath, fi.Mode(), uid, gid); err != nil {
+                return err
+            }
+            return copts.options(s).syncer.Sync(s, backupPath, nil)
+        })
+    }
+    if _, vuid, vgid, err := getFileInfo(target); err == nil && (vuid != uid || vgid != gid) {
+        if plan.condition == REPAIR_OK {
+            plan.condition = REPAIR_WRONG_OWNER
+        }
+        plan.add(fmt.Sprintf("change owner of %s from %d:%d to %d:%d", target, vuid, vgid, uid, gid), func() error {
+            return os.Chown(target, int(uid), int(gid))
+        })
+    }
+}   // }}}
+
+// orphan makes the plan of a synced path which is not in WHATTOSYNC. It's
+// synced back and restored like stop does.
+func (self *RepairPlan) orphan(copts *ConfigOptions, cancel <-chan struct{}) { // {{{
+    s := self.source
+    self.condition = REPAIR_ORPHAN
+    self.add("sync back and restore "+s, func() error {
+        paths := []string{s}
+        sync(copts, &paths, cancel)
+        unsync(copts, &paths, true, cancel)
+        if target, err := os.Readlink(s); err == nil || isBound(s, copts.lockfile) {
+            return errors.New("Sync path was not restored, still linked to: " + target)
+        }
+        return nil
+    })
+}   // }}}
+
+// repair classifies every sync path, path in the state file and path found
+// from TMPFS, prints the condition of each and the steps which fix it, and
+// runs the steps unless dryRun is true. Returns false if a path could not be
+// fixed or if the repair was interrupted.
+func repair(copts *ConfigOptions, dryRun bool, cancel <-chan struct{}) bool { // {{{
+    st, err := readState(copts.lockfile)
+    if err != nil {
+        LOG.Warn("repair: Could not read the state file: %s", err)
+    }
+    if dryRun {
+        fmt.Printf("Dry run, nothing is changed.\n")
+    }
+    configured := make(map[string]bool)
+    for _, s := range copts.syncPaths {
+        configured[path.Clean(s)] = true
+    }
+    ok := true
+    for _, s := range repairSources(copts, st) {
+        if interrupted(cancel) {
+            LOG.Warn("repair: Interrupted, skipping remaining sync sources.")
+            return false
+        }
+        plan := classifyPath(copts, st, s)
+        if plan.condition == REPAIR_OK && !configured[s] {
+            plan.orphan(copts, cancel)
+        }
+        fmt.Printf("%s: %s\n", s, plan.condition)
+        if plan.note != "" {
+            fmt.Printf("    %s\n", plan.note)
+        }
+        if plan.condition == REPAIR_UNKNOWN {
+            ok = false
+        }
+        for _, step := range plan.steps {
+            fmt.Printf("    %s\n", step.desc)
+            if dryRun {
+                continue
+            }
+            if err := step.do(); err != nil {
+                LOG.Err("repair: %s: %s", s, err)
+                ok = false
+                break
+            }
+        }
+    }
+    return ok
+}   // }}}
+
+// vim: set sts=4 ts=4 sw=4 et foldmethod=marker:
@@ -0,0 +1,214 @@
+// Copyright (C) 2012 Esa Määttä <esa.maatta@iki.fi>
+// This file is released under the GNU GPL, version 3 or a later revision.
+// For further details see the COPYING file.
+
+package main
+
+import (
+    "errors"
+    "fmt"
+    "os"
+    "path"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+const (
+    // SNAPSHOT_POSTFIX is the file name extension of snapshot archives.
+    SNAPSHOT_POSTFIX = ".tar.gz"
+    // SNAPSHOT_TIME_FORMAT is the time format of snapshot archive names.
+    SNAPSHOT_TIME_FORMAT = "20060102-150405.000"
+    // DEFAULT_SNAPSHOT_KEEP is the number of snapshots kept of every sync path
+    // when no SNAPSHOT_KEEP is defined in the config file.
+    DEFAULT_SNAPSHOT_KEEP = 5
+)
+
+// SnapshotOptions are the options of backup snapshots.
+type SnapshotOptions struct {
+    // Snapshots are not taken if dir is empty
+    dir string
+    // Number of snapshots kept of every sync path, 0 keeps all
+    keep int
+    // Snapshots older than this are removed, 0 keeps all
+    maxAge time.Duration
+    // Whether a snapshot is taken after every sync
+    afterSync bool
+}
+
+// readSnapshotOptions reads SNAPSHOT_DIR, SNAPSHOT_KEEP, SNAPSHOT_MAX_AGE and
+// SNAPSHOT_AFTER_SYNC options from given option data.
+func readSnapshotOptions(data map[string]*string) (sopts SnapshotOptions, err error) { // {{{
+    sopts.keep = DEFAULT_SNAPSHOT_KEEP
+
+    if v, ok := data["SNAPSHOT_DIR"]; ok {
+        if sopts.dir, err = expandPath(strings.TrimSpace(*v)); err != nil {
+            err = errors.New("SNAPSHOT_DIR: " + err.Error())
+            return
+        }
+        if !path.IsAbs(sopts.dir) {
+            err = errors.New("SNAPSHOT_DIR path must be absolute.")
+            return
+        }
+    }
+
+    if v, ok := data["SNAPSHOT_KEEP"]; ok {
+        if sopts.keep, err = strconv.Atoi(strings.TrimSpace(*v)); err != nil || sopts.keep < 0 {
+            err = errors.New("Invalid SNAPSHOT_KEEP: " + *v)
+            return
+        }
+    }
+
+    if v, ok := data["SNAPSHOT_MAX_AGE"]; ok {
+        if sopts.maxAge, err = time.ParseDuration(strings.TrimSpace(*v)); err != nil {
+            err = errors.New("Invalid SNAPSHOT_MAX_AGE: " + err.Error())
+            return
+        }
+        if sopts.maxAge < 0 {
+            err = errors.New("SNAPSHOT_MAX_AGE must not be negative.")
+            return
+        }
+    }
+
+    if v, ok := data["SNAPSHOT_AFTER_SYNC"]; ok {
+        if sopts.afterSync, err = parseBool(*v); err != nil {
+            err = errors.New("SNAPSHOT_AFTER_SYNC: " + err.Error())
+            return
+        }
+        if sopts.afterSync && sopts.dir == "" {
+            err = errors.New("SNAPSHOT_AFTER_SYNC requires SNAPSHOT_DIR.")
+            return
+        }
+    }
+    return
+}   // }}}
+
+// getSnapshotDir returns the directory of the snapshots of given sync path.
+// The path of the sync path is mirrored under the snapshot dir.
+func getSnapshotDir(snapshotDir string, s string) string { // {{{
+    return path.Join(snapshotDir, path.Clean(s))
+}   // }}}
+
+// snapshot takes a snapshot of every given sync path. Returns false if any
+// of the snapshots failed.
+func snapshot(copts *ConfigOptions, syncSources *[]string, cancel <-chan struct{}) bool { // {{{
+    if copts.snapshot.dir == "" {
+        LOG.Err("snapshot: No SNAPSHOT_DIR defined.")
+        return false
+    }
+    st, err := readState(copts.lockfile)
+    if err != nil {
+        LOG.Warn("snapshot: Could not read the state file: %s", err)
+    }
+    ok := true
+    for _, s := range *syncSources {
+        if interrupted(cancel) {
+            LOG.Warn("snapshot: Interrupted, skipping remaining sync sources.")
+            return false
+        }
+        // A synced path is a symlink to tmpfs, the disk copy of it is the
+        // backup path. With archive backing the tmpfs copy is archived, as
+        // it's the same as the archive after a sync. A bind-mounted path has
+        // its disk copy at the disk mount path.
+        src := s
+        if st.bound(s, copts.lockfile) {
+            src = getDiskMountPath(copts.lockfile, s)
+        } else if isSynced(s, copts.tmpfsPath) {
+            src = getBackupPath(s)
+            if st.archived(s) {
+                src, _ = os.Readlink(s)
+            }
+        }
+        if fi, err := os.Stat(src); err != nil || !fi.IsDir() {
+            LOG.Warn("snapshot: Skipping sync source, '%s' was not a directory: %s", src, s)
+            ok = false
+            continue
+        }
+        if err := takeSnapshot(copts.snapshot, s, src, cancel); err != nil {
+            LOG.Err("snapshot: %s: %s", s, err)
+            ok = false
+        }
+    }
+    return ok
+}   // }}}
+
+// takeSnapshot archives directory src, which is the disk copy of sync path s,
+// to the snapshot dir of s and removes the snapshots which are too many or too
+// old.
+func takeSnapshot(sopts SnapshotOptions, s string, src string, cancel <-chan struct{}) error { // {{{
+    dir := getSnapshotDir(sopts.dir, s)
+    if err := os.MkdirAll(dir, 0700); err != nil {
+        return err
+    }
+    fn := path.Join(dir, time.Now().Format(SNAPSHOT_TIME_FORMAT)+SNAPSHOT_POSTFIX)
+    if exists(fn) {
+        return errors.New("Snapshot already exists: " + fn)
+    }
+    if err := writeTarGz(src, fn, cancel); err != nil {
+        return err
+    }
+    LOG.Info("snapshot: Wrote snapshot '%s'.", fn)
+    return pruneSnapshots(sopts, dir)
+}   // }}}
+
+// listSnapshots returns the snapshot archives in given dir, newest first.
+func listSnapshots(dir string) (snapshots []string, err error) { // {{{
+    f, err := os.Open(dir)
+    if err != nil {
+        if os.IsNotExist(err) {
+            err = nil
+        }
+        return
+    }
+    names, err := f.Readdirnames(-1)
+    f.Close()
+    if err != nil {
+        return
+    }
+    for _, n := range names {
+        if _, terr := snapshotTime(n); terr == nil {
+            snapshots = append(snapshots, n)
+        }
+    }
+    // Time format sorts in chronological order
+    sort.Sort(sort.Reverse(sort.StringSlice(snapshots)))
+    return
+}   // }}}
+
+// snapshotTime returns the time of given snapshot archive name.
+func snapshotTime(name string) (time.Time, error) { // {{{
+    if !strings.HasSuffix(name, SNAPSHOT_POSTFIX) {
+        return time.Time{}, fmt.Errorf("Not a snapshot: %s", name)
+    }
+    return time.ParseInLocation(SNAPSHOT_TIME_FORMAT, strings.TrimSuffix(name, SNAPSHOT_POSTFIX), time.Local)
+}   // }}}
+
+// pruneSnapshots removes the snapshots in given dir which exceed the number
+// of kept snapshots or are older than the maximum age. The newest snapshot is
+// always kept.
+func pruneSnapshots(sopts SnapshotOptions, dir string) error { // {{{
+    snapshots, err := listSnapshots(dir)
+    if err != nil {
+        return err
+    }
+    for i, n := range snapshots {
+        if i == 0 {
+            continue
+        }
+        remove := sopts.keep > 0 && i >= sopts.keep
+        if t, _ := snapshotTime(n); sopts.maxAge > 0 && time.Since(t) > sopts.maxAge {
+            remove = true
+        }
+        if !remove {
+            continue
+        }
+        if err = os.Remove(path.Join(dir, n)); err != nil {
+            return err
+        }
+        LOG.Debug("snapshot: Removed old snapshot '%s'.", path.Join(dir, n))
+    }
+    return nil
+}   // }}}
+
+// vim: set sts=4 ts=4 sw=4 et foldmethod=marker:
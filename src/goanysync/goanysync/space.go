@@ -0,0 +1,147 @@
+// Copyright (C) 2012 Esa Määttä <esa.maatta@iki.fi>
+// This file is released under the GNU GPL, version 3 or a later revision.
+// For further details see the COPYING file.
+
+package main
+
+import (
+    "errors"
+    "fmt"
+    "os"
+    "path"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "syscall"
+)
+
+// Headroom is the amount of TMPFS space left free when sync paths are copied
+// to it. It's either an absolute size or a percentage of the TMPFS size.
+type Headroom struct {
+    bytes   int64
+    percent int
+}
+
+func (self Headroom) String() string { // {{{
+    if self.percent > 0 {
+        return fmt.Sprintf("%d%%", self.percent)
+    }
+    return formatSize(self.bytes)
+}   // }}}
+
+// of returns the headroom in bytes for a TMPFS of given total size.
+func (self Headroom) of(total int64) int64 { // {{{
+    if self.percent > 0 {
+        return total / 100 * int64(self.percent)
+    }
+    return self.bytes
+}   // }}}
+
+// readHeadroom reads TMPFS_HEADROOM option from given option data. The value
+// is a size in bytes with an optional K, M, G or T suffix, or a percentage
+// of the TMPFS size, e.g. "10%". Defaults to no headroom.
+func readHeadroom(data map[string]*string) (h Headroom, err error) { // {{{
+    v, ok := data["TMPFS_HEADROOM"]
+    if !ok {
+        return
+    }
+    s := strings.TrimSpace(*v)
+    if strings.HasSuffix(s, "%") {
+        if h.percent, err = strconv.Atoi(strings.TrimSuffix(s, "%")); err != nil || h.percent < 0 || h.percent >= 100 {
+            err = errors.New("Invalid TMPFS_HEADROOM: " + *v)
+        }
+        return
+    }
+    if h.bytes, err = parseSize(s); err != nil {
+        err = errors.New("Invalid TMPFS_HEADROOM: " + *v)
+    }
+    return
+}   // }}}
+
+// parseSize parses a non-negative size in bytes with an optional K, M, G or T
+// suffix.
+func parseSize(s string) (int64, error) { // {{{
+    multiplier := int64(1)
+    if n := len(s); n > 0 {
+        if i := strings.IndexByte("KMGT", strings.ToUpper(s)[n-1]); i >= 0 {
+            multiplier = int64(1) << (10 * uint(i+1))
+            s = s[:n-1]
+        }
+    }
+    n, err := strconv.ParseInt(s, 10, 64)
+    if err != nil || n < 0 {
+        return 0, errors.New("Invalid size: " + s)
+    }
+    return n * multiplier, nil
+}   // }}}
+
+// formatSize formats given size in bytes in megabytes.
+func formatSize(bytes int64) string { // {{{
+    return fmt.Sprintf("%.1fM", float64(bytes)/(1024*1024))
+}   // }}}
+
+// readPriority reads PRIORITY option from given option data.
+func readPriority(data map[string]*string) (priority int, err error) { // {{{
+    if v, ok := data["PRIORITY"]; ok {
+        if priority, err = strconv.Atoi(strings.TrimSpace(*v)); err != nil {
+            err = errors.New("Invalid PRIORITY: " + *v)
+        }
+    }
+    return
+}   // }}}
+
+// byPriority returns given sync paths ordered by their PRIORITY, highest
+// first. Paths with the same priority keep their order.
+func byPriority(copts *ConfigOptions, syncSources []string) []string { // {{{
+    sorted := append([]string(nil), syncSources...)
+    sort.SliceStable(sorted, func(i, j int) bool {
+        return copts.options(sorted[i]).priority > copts.options(sorted[j]).priority
+    })
+    return sorted
+}   // }}}
+
+// dirSize returns the space the contents of given directory would take in
+// TMPFS. Sizes of regular files are rounded up to whole blocks of given size.
+// Excludes are not taken into account, so the size may be an overestimate.
+func dirSize(dir string, blockSize int64) (size int64, err error) { // {{{
+    err = filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+        if err != nil {
+            return err
+        }
+        if fi.Mode().IsRegular() {
+            size += (fi.Size() + blockSize - 1) / blockSize * blockSize
+        }
+        return nil
+    })
+    return
+}   // }}}
+
+// checkFreeSpace checks that sync path s fits to the free space of TMPFS
+// with given headroom left over. If TMPFS does not exist yet, which happens in
+// the dry run mode, the free space of its nearest existing parent is checked.
+func checkFreeSpace(s string, tmpfs string, headroom Headroom) error { // {{{
+    p := tmpfs
+    for !exists(p) {
+        p = path.Dir(p)
+    }
+    var fs syscall.Statfs_t
+    if err := syscall.Statfs(p, &fs); err != nil {
+        return fmt.Errorf("Could not get the free space of TMPFS '%s': %s", tmpfs, err)
+    }
+    blockSize := int64(fs.Bsize)
+    free := int64(fs.Bavail) * blockSize
+    reserved := headroom.of(int64(fs.Blocks) * blockSize)
+
+    size, err := dirSize(s, blockSize)
+    if err != nil {
+        return fmt.Errorf("Could not get the size of '%s': %s", s, err)
+    }
+    if size+reserved > free {
+        return fmt.Errorf("Not enough space in TMPFS for '%s': needs %s, %s free with %s headroom.",
+            s, formatSize(size), formatSize(free), headroom)
+    }
+    return nil
+}   // }}}
+
+// vim: set sts=4 ts=4 sw=4 et foldmethod=marker:
@@ -0,0 +1,239 @@
+// Copyright (C) 2012 Esa Määttä <esa.maatta@iki.fi>
+// This file is released under the GNU GPL, version 3 or a later revision.
+// For further details see the COPYING file.
+
+package main
+
+import (
+    "encoding/json"
+    "os"
+    "path"
+    "sort"
+    "time"
+)
+
+// STATE_POSTFIX is appended to the lock file path to get the path of the state
+// file, which records the sync paths goanysync has initialized.
+const STATE_POSTFIX = ".state"
+
+// STATE_TIME_FORMAT is the format of the times shown from the state file.
+const STATE_TIME_FORMAT = "2006-01-02 15:04:05"
+
+// PathState records how a sync path was initialized. The recorded paths are
+// used instead of ones generated from the current config, so that a path is
+// restored right even if the config has changed since it was initialized.
+type PathState struct {
+    Source       string `json:"source"`
+    Tmpfs        string `json:"tmpfs"`
+    VolatilePath string `json:"volatile_path"`
+    // The backup dir, the archive or the disk mount path of the source
+    BackupPath string `json:"backup_path"`
+    // Owner and permissions of the source directory
+    Uid  uint        `json:"uid"`
+    Gid  uint        `json:"gid"`
+    Perm os.FileMode `json:"perm"`
+    // Sync mode and backing of the path
+    Mode     string    `json:"mode"`
+    Backing  string    `json:"backing"`
+    InitTime time.Time `json:"init_time"`
+    // Zero if the path has not been synced
+    LastSync time.Time `json:"last_sync"`
+}
+
+// State is the content of the state file.
+type State struct {
+    Paths []*PathState `json:"paths"`
+}
+
+// getStatePath returns the path of the state file.
+func getStatePath(lockfile string) string { // {{{
+    return lockfile + STATE_POSTFIX
+}   // }}}
+
+// readState reads the state file. A missing state file is not an error, in
+// that case nil state is returned.
+func readState(lockfile string) (*State, error) { // {{{
+    f, err := os.Open(getStatePath(lockfile))
+    if err != nil {
+        if os.IsNotExist(err) {
+            return nil, nil
+        }
+        return nil, err
+    }
+    defer f.Close()
+    st := &State{}
+    if err = json.NewDecoder(f).Decode(st); err != nil {
+        return nil, err
+    }
+    return st, nil
+}   // }}}
+
+// writeState writes the state file atomically. The state file is removed
+// when no paths are left.
+func writeState(lockfile string, st *State) error { // {{{
+    fn := getStatePath(lockfile)
+    if len(st.Paths) == 0 {
+        if err := os.Remove(fn); err != nil && !os.IsNotExist(err) {
+            return err
+        }
+        return nil
+    }
+    sort.Slice(st.Paths, func(i, j int) bool { return st.Paths[i].Source < st.Paths[j].Source })
+
+    tmp := fn + ".tmp"
+    f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+    if err != nil {
+        return err
+    }
+    enc := json.NewEncoder(f)
+    enc.SetIndent("", "    ")
+    if err = enc.Encode(st); err == nil {
+        err = f.Sync()
+    }
+    if cerr := f.Close(); err == nil {
+        err = cerr
+    }
+    if err != nil {
+        os.Remove(tmp)
+        return err
+    }
+    return os.Rename(tmp, fn)
+}   // }}}
+
+// updateState reads the state file, changes it with given function and writes
+// it back. Errors are logged as warnings, as the state file is only used to
+// make recovery more reliable. A state file which can not be read is left
+// untouched.
+func updateState(lockfile string, update func(st *State)) { // {{{
+    st, err := readState(lockfile)
+    if err != nil {
+        LOG.Warn("Could not read the state file: %s", err)
+        return
+    }
+    if st == nil {
+        st = &State{}
+    }
+    update(st)
+    if err = writeState(lockfile, st); err != nil {
+        LOG.Warn("Could not write the state file: %s", err)
+    }
+}   // }}}
+
+// find returns the state of given sync path, or nil if it's not recorded.
+func (self *State) find(s string) *PathState { // {{{
+    if self == nil {
+        return nil
+    }
+    for _, ps := range self.Paths {
+        if ps.Source == path.Clean(s) {
+            return ps
+        }
+    }
+    return nil
+}   // }}}
+
+// bound checks whether sync path s is bind-mounted or overlaid. A path
+// recorded in symlink mode is never bound, others are checked from the
+// mounts.
+func (self *State) bound(s string, lockfile string) bool { // {{{
+    if ps := self.find(s); ps != nil && ps.Mode == MODE_SYMLINK {
+        return false
+    }
+    return isBound(s, lockfile)
+}   // }}}
+
+// archived checks whether the persistent copy of sync path s is an archive.
+// The backing recorded in the state file is used if s is recorded, otherwise
+// it's found out from the disk.
+func (self *State) archived(s string) bool { // {{{
+    if ps := self.find(s); ps != nil {
+        return ps.Backing == BACKING_ARCHIVE
+    }
+    return isArchived(s)
+}   // }}}
+
+// set records the state of a sync path, replacing an earlier state of it.
+func (self *State) set(ps *PathState) { // {{{
+    self.remove(ps.Source)
+    self.Paths = append(self.Paths, ps)
+}   // }}}
+
+// remove removes the state of given sync path.
+func (self *State) remove(s string) { // {{{
+    for i, ps := range self.Paths {
+        if ps.Source == path.Clean(s) {
+            self.Paths = append(self.Paths[:i], self.Paths[i+1:]...)
+            return
+        }
+    }
+}   // }}}
+
+// extra returns the states of the recorded paths which are not in given sync
+// paths.
+func (self *State) extra(syncSources *[]string) (extra []*PathState) { // {{{
+    if self == nil {
+        return
+    }
+    for _, ps := range self.Paths {
+        found := false
+        for _, s := range *syncSources {
+            found = found || path.Clean(s) == ps.Source
+        }
+        if !found {
+            extra = append(extra, ps)
+        }
+    }
+    return
+}   // }}}
+
+// recordInit records that sync path s, whose Stat before the initialization
+// is fi, was initialized with given volatile path. Nothing is recorded in the
+// dry run mode, like in the functions below.
+func recordInit(copts *ConfigOptions, s string, volatilePath string, fi os.FileInfo, uid, gid uint) { // {{{
+    if copts.dryRun {
+        return
+    }
+    popts := copts.options(s)
+    ps := &PathState{
+        Source:       path.Clean(s),
+        Tmpfs:        copts.tmpfsPath,
+        VolatilePath: volatilePath,
+        BackupPath:   getBackupPath(s),
+        Uid:          uid,
+        Gid:          gid,
+        Perm:         fi.Mode().Perm(),
+        Mode:         popts.mode,
+        Backing:      popts.backing,
+        InitTime:     time.Now(),
+    }
+    if popts.backing == BACKING_ARCHIVE {
+        ps.BackupPath = getArchivePath(s)
+    }
+    if popts.mode != MODE_SYMLINK {
+        ps.BackupPath = getDiskMountPath(copts.lockfile, s)
+    }
+    updateState(copts.lockfile, func(st *State) { st.set(ps) })
+}   // }}}
+
+// recordSync records a successful sync of sync path s.
+func recordSync(copts *ConfigOptions, s string) { // {{{
+    if copts.dryRun {
+        return
+    }
+    updateState(copts.lockfile, func(st *State) {
+        if ps := st.find(s); ps != nil {
+            ps.LastSync = time.Now()
+        }
+    })
+}   // }}}
+
+// recordUnsync removes sync path s from the state file after it has been
+// restored.
+func recordUnsync(copts *ConfigOptions, s string) { // {{{
+    if copts.dryRun {
+        return
+    }
+    updateState(copts.lockfile, func(st *State) { st.remove(s) })
+}   // }}}
+
+// vim: set sts=4 ts=4 sw=4 et foldmethod=marker:
@@ -0,0 +1,492 @@
+// Copyright (C) 2012 Esa Määttä <esa.maatta@iki.fi>
+// This file is released under the GNU GPL, version 3 or a later revision.
+// For further details see the COPYING file.
+
+package main
+
+import (
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "os/exec"
+    "path"
+    "path/filepath"
+    "strings"
+    "syscall"
+    "time"
+)
+
+// Syncer mirrors the content of a source directory to a destination
+// directory. Files in the destination which don't exist in the source are
+// deleted, like with "rsync -a --delete".
+type Syncer interface {
+    // Sync makes dst a copy of src. Both src and dst may be symlinks to
+    // directories. If cancel is closed, Sync may stop early and return
+    // errInterrupted.
+    Sync(src, dst string, cancel <-chan struct{}) error
+    // Command returns the command line Sync runs for given paths, for
+    // messages.
+    Command(src, dst string) string
+    // String returns a description of the syncer for messages.
+    String() string
+}
+
+// Names of the available syncers for the SYNCER config option.
+const (
+    SYNCER_RSYNC = "rsync"
+    SYNCER_CP    = "cp"
+    SYNCER_GO    = "go"
+)
+
+// CommandError is returned by command based syncers when the command fails.
+type CommandError struct {
+    Args   []string
+    Err    error
+    Output []byte
+}
+
+func (self *CommandError) Error() string { // {{{
+    return fmt.Sprintf("'%s' => with command: %s", self.Err, strings.Join(self.Args, " "))
+}   // }}}
+
+// runSyncCommand runs given command with runCommand and wraps a possible
+// error to a CommandError.
+func runSyncCommand(cmd *exec.Cmd, cancel <-chan struct{}) error { // {{{
+    output, err := runCommand(cmd, cancel)
+    if err != nil {
+        return &CommandError{cmd.Args, err, output}
+    }
+    return nil
+}   // }}}
+
+// newSyncer creates a syncer by given name. For command based syncers the
+// given bin is used as the command if it's not empty and args are passed to
+// the command as extra arguments. Excludes are rsync style exclude patterns
+// for files which are not synced.
+func newSyncer(name string, bin string, args []string, excludes []string) (Syncer, error) { // {{{
+    switch name {
+    case SYNCER_RSYNC:
+        if bin == "" {
+            bin = "rsync"
+        }
+        return &rsyncSyncer{bin, args, excludes}, nil
+    case SYNCER_CP:
+        if bin == "" {
+            bin = "cp"
+        }
+        if len(excludes) > 0 {
+            return nil, errors.New("Exclude patterns are not supported by the cp syncer.")
+        }
+        return &cpSyncer{bin, args}, nil
+    case SYNCER_GO:
+        if len(args) > 0 {
+            return nil, errors.New("Syncer arguments are not supported by the go syncer.")
+        }
+        return &goSyncer{excludes}, nil
+    }
+    return nil, errors.New("Unknown syncer: " + name)
+}   // }}}
+
+// syncerCommand returns the external command used by given syncer, or an
+// empty string for syncers which don't need one.
+func syncerCommand(syncer Syncer) string { // {{{
+    switch s := syncer.(type) {
+    case *rsyncSyncer:
+        return s.bin
+    case *cpSyncer:
+        return s.bin
+    case dryRunSyncer:
+        return syncerCommand(s.Syncer)
+    }
+    return ""
+}   // }}}
+
+// --------------------------------------------------------------------------
+
+// dryRunSyncer logs the command of the wrapped syncer instead of running it.
+type dryRunSyncer struct {
+    Syncer
+}
+
+func (self dryRunSyncer) Sync(src, dst string, cancel <-chan struct{}) error { // {{{
+    LOG.Info("Dry run: %s", self.Command(src, dst))
+    return nil
+}   // }}}
+
+// --------------------------------------------------------------------------
+
+// rsyncSyncer syncs with "rsync -a --delete".
+type rsyncSyncer struct {
+    bin      string
+    args     []string
+    excludes []string
+}
+
+func (self *rsyncSyncer) Sync(src, dst string, cancel <-chan struct{}) error { // {{{
+    return runSyncCommand(self.command(src, dst), cancel)
+}   // }}}
+
+func (self *rsyncSyncer) Command(src, dst string) string { // {{{
+    return strings.Join(self.command(src, dst).Args, " ")
+}   // }}}
+
+// command returns the rsync command which syncs src to dst.
+func (self *rsyncSyncer) command(src, dst string) *exec.Cmd { // {{{
+    args := []string{"-a", "--delete"}
+    for _, e := range self.excludes {
+        args = append(args, "--exclude="+e)
+    }
+    args = append(args, self.args...)
+    args = append(args, src+"/", dst)
+    return exec.Command(self.bin, args...)
+}   // }}}
+
+func (self *rsyncSyncer) String() string { // {{{
+    return SYNCER_RSYNC + " (" + self.bin + ")"
+}   // }}}
+
+// --------------------------------------------------------------------------
+
+// cpSyncer syncs with "cp -a". As cp has no delete option, files not in the
+// source are first deleted from the destination. Every file is copied on
+// every sync.
+type cpSyncer struct {
+    bin  string
+    args []string
+}
+
+func (self *cpSyncer) Sync(src, dst string, cancel <-chan struct{}) error { // {{{
+    if err := (&goSyncer{}).deleteExtra(src, dst, "", true, cancel); err != nil {
+        return err
+    }
+    return runSyncCommand(self.command(src, dst), cancel)
+}   // }}}
+
+func (self *cpSyncer) Command(src, dst string) string { // {{{
+    return strings.Join(self.command(src, dst).Args, " ")
+}   // }}}
+
+// command returns the cp command which copies src to dst. Files not in src
+// are deleted from dst before it's run.
+func (self *cpSyncer) command(src, dst string) *exec.Cmd { // {{{
+    args := append([]string{"-a"}, self.args...)
+    args = append(args, src+"/.", dst+"/")
+    return exec.Command(self.bin, args...)
+}   // }}}
+
+func (self *cpSyncer) String() string { // {{{
+    return SYNCER_CP + " (" + self.bin + ")"
+}   // }}}
+
+// --------------------------------------------------------------------------
+
+// goSyncer is a native syncer which needs no external programs. Like rsync it
+// preserves permissions, ownership, modification times, symlinks and special
+// files, and copies only files which differ in size or modification time.
+type goSyncer struct {
+    excludes []string
+}
+
+func (self *goSyncer) Sync(src, dst string, cancel <-chan struct{}) error { // {{{
+    sfi, err := os.Stat(src)
+    if err != nil {
+        return err
+    }
+    if !sfi.IsDir() {
+        return errors.New("Sync source was not a directory: " + src)
+    }
+    // Destination symlink is followed like with rsync when the source path
+    // ends with a slash.
+    if dfi, err := os.Stat(dst); err == nil && dfi.IsDir() {
+        if dst, err = filepath.EvalSymlinks(dst); err != nil {
+            return err
+        }
+    }
+    if src, err = filepath.EvalSymlinks(src); err != nil {
+        return err
+    }
+    return self.mirror(src, dst, "", sfi, cancel)
+}   // }}}
+
+func (self *goSyncer) Command(src, dst string) string { // {{{
+    return fmt.Sprintf("%s: %s/ -> %s", self, src, dst)
+}   // }}}
+
+func (self *goSyncer) String() string { // {{{
+    return SYNCER_GO + " (native)"
+}   // }}}
+
+// mirror makes dst a copy of src, where sfi is the Lstat of src and rel is
+// the path of src relative to the root of the sync.
+func (self *goSyncer) mirror(src, dst, rel string, sfi os.FileInfo, cancel <-chan struct{}) error { // {{{
+    if interrupted(cancel) {
+        return errInterrupted
+    }
+
+    // Remove destination if its type differs from the source.
+    dfi, err := os.Lstat(dst)
+    if err == nil && dfi.Mode()&os.ModeType != sfi.Mode()&os.ModeType {
+        if err = removeAll(dst); err != nil {
+            return err
+        }
+        dfi = nil
+    } else if err != nil {
+        if !os.IsNotExist(err) {
+            return err
+        }
+        dfi = nil
+    }
+
+    mode := sfi.Mode()
+    switch {
+    case mode.IsDir():
+        // The directory is kept writable while it's filled, like rsync
+        // does, and its own mode is set after its children.
+        if dfi == nil {
+            if err := os.Mkdir(dst, 0700); err != nil {
+                return err
+            }
+        } else if err := ensureWritable(dst, dfi); err != nil {
+            return err
+        }
+        if err := self.deleteExtra(src, dst, rel, false, cancel); err != nil {
+            return err
+        }
+        f, err := os.Open(src)
+        if err != nil {
+            return err
+        }
+        sfis, err := f.Readdir(-1)
+        f.Close()
+        if err != nil {
+            return err
+        }
+        for _, fi := range sfis {
+            frel := path.Join(rel, fi.Name())
+            if self.excluded(frel, fi.IsDir()) {
+                continue
+            }
+            if err := self.mirror(filepath.Join(src, fi.Name()), filepath.Join(dst, fi.Name()), frel, fi, cancel); err != nil {
+                return err
+            }
+        }
+    case mode&os.ModeSymlink != 0:
+        target, err := os.Readlink(src)
+        if err != nil {
+            return err
+        }
+        if dfi != nil {
+            if dtarget, err := os.Readlink(dst); err == nil && dtarget == target {
+                return copyOwner(dst, sfi)
+            }
+            if err := os.Remove(dst); err != nil {
+                return err
+            }
+        }
+        if err := os.Symlink(target, dst); err != nil {
+            return err
+        }
+        return copyOwner(dst, sfi)
+    case mode.IsRegular():
+        if dfi == nil || dfi.Size() != sfi.Size() || !dfi.ModTime().Equal(sfi.ModTime()) {
+            if err := copyFile(src, dst); err != nil {
+                return err
+            }
+        }
+    case mode&os.ModeSocket != 0:
+        // Sockets can't be copied, rsync skips them too.
+        return nil
+    default:
+        // Devices and named pipes
+        st, ok := sfi.Sys().(*syscall.Stat_t)
+        if !ok {
+            return errors.New("Stat failed on: " + src)
+        }
+        if dfi != nil {
+            if dst_st, ok := dfi.Sys().(*syscall.Stat_t); ok && dst_st.Mode == st.Mode && dst_st.Rdev == st.Rdev {
+                break
+            }
+            if err := os.Remove(dst); err != nil {
+                return err
+            }
+        }
+        if err := syscall.Mknod(dst, st.Mode, int(st.Rdev)); err != nil {
+            return &os.PathError{Op: "mknod", Path: dst, Err: err}
+        }
+    }
+    return copyAttributes(dst, sfi)
+}   // }}}
+
+// deleteExtra removes files from dst directory which don't exist in src or
+// which are of different type in src. Excluded files are not removed. rel is
+// the path of dst relative to the root of the sync. If recursive is true,
+// subdirectories are handled too.
+func (self *goSyncer) deleteExtra(src, dst, rel string, recursive bool, cancel <-chan struct{}) error { // {{{
+    f, err := os.Open(dst)
+    if err != nil {
+        return err
+    }
+    dfis, err := f.Readdir(-1)
+    f.Close()
+    if err != nil {
+        return err
+    }
+
+    for _, dfi := range dfis {
+        if interrupted(cancel) {
+            return errInterrupted
+        }
+        drel := path.Join(rel, dfi.Name())
+        if self.excluded(drel, dfi.IsDir()) {
+            continue
+        }
+        sp := filepath.Join(src, dfi.Name())
+        dp := filepath.Join(dst, dfi.Name())
+        sfi, err := os.Lstat(sp)
+        if err != nil && !os.IsNotExist(err) {
+            return err
+        }
+        if err != nil || sfi.Mode()&os.ModeType != dfi.Mode()&os.ModeType {
+            if err := removeAll(dp); err != nil {
+                return err
+            }
+            continue
+        }
+        if recursive && dfi.IsDir() {
+            // The syncer run after this sets the mode of the dir back
+            if err := ensureWritable(dp, dfi); err != nil {
+                return err
+            }
+            if err := self.deleteExtra(sp, dp, drel, true, cancel); err != nil {
+                return err
+            }
+        }
+    }
+    return nil
+}   // }}}
+
+// excluded checks whether given path relative to the root of the sync matches
+// any of the exclude patterns. Patterns follow the basic rsync rules: a
+// pattern ending with a slash matches only directories, a pattern starting
+// with a slash is matched against the whole relative path, other patterns
+// containing a slash are matched against the end of the path, and the rest
+// against the last path element.
+func (self *goSyncer) excluded(rel string, isDir bool) bool { // {{{
+    for _, pattern := range self.excludes {
+        if strings.HasSuffix(pattern, "/") {
+            if !isDir {
+                continue
+            }
+            pattern = strings.TrimRight(pattern, "/")
+        }
+        var matched bool
+        switch {
+        case strings.HasPrefix(pattern, "/"):
+            matched, _ = path.Match(pattern[1:], rel)
+        case strings.Contains(pattern, "/"):
+            for p := rel; p != "" && !matched; {
+                matched, _ = path.Match(pattern, p)
+                i := strings.Index(p, "/")
+                if i < 0 {
+                    break
+                }
+                p = p[i+1:]
+            }
+        default:
+            matched, _ = path.Match(pattern, path.Base(rel))
+        }
+        if matched {
+            return true
+        }
+    }
+    return false
+}   // }}}
+
+// ensureWritable adds the missing user permissions to directory p, whose
+// Lstat is fi, so that it can be listed and files can be created in it and
+// removed from it.
+func ensureWritable(p string, fi os.FileInfo) error { // {{{
+    if fi.Mode().Perm()&0700 == 0700 {
+        return nil
+    }
+    return os.Chmod(p, fi.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)|0700)
+}   // }}}
+
+// removeAll removes p and everything under it like os.RemoveAll. If that
+// fails, the directories under p are made writable and the removal is tried
+// again.
+func removeAll(p string) error { // {{{
+    if err := os.RemoveAll(p); err == nil {
+        return nil
+    }
+    filepath.Walk(p, func(wp string, fi os.FileInfo, err error) error {
+        if err == nil && fi.IsDir() {
+            ensureWritable(wp, fi)
+        }
+        return nil
+    })
+    return os.RemoveAll(p)
+}   // }}}
+
+// copyFile copies regular file src to dst through a temporary file, so that
+// dst is replaced atomically and other hard links of dst are not modified.
+func copyFile(src, dst string) error { // {{{
+    sf, err := os.Open(src)
+    if err != nil {
+        return err
+    }
+    defer sf.Close()
+
+    tmp := filepath.Join(filepath.Dir(dst), ".goanysync-tmp."+filepath.Base(dst))
+    df, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+    if err != nil {
+        return err
+    }
+    if _, err = io.Copy(df, sf); err != nil {
+        df.Close()
+        os.Remove(tmp)
+        return err
+    }
+    if err = df.Close(); err != nil {
+        os.Remove(tmp)
+        return err
+    }
+    if err = os.Rename(tmp, dst); err != nil {
+        os.Remove(tmp)
+        return err
+    }
+    return nil
+}   // }}}
+
+// copyOwner sets the owner of dst to the owner in sfi. Errors from changing
+// the owner are ignored for non-root users as they can't give files away.
+func copyOwner(dst string, sfi os.FileInfo) error { // {{{
+    uid, gid, err := getFileUserAndGroupId(sfi)
+    if err != nil {
+        return err
+    }
+    if err := os.Lchown(dst, int(uid), int(gid)); err != nil && os.Geteuid() == 0 {
+        return err
+    }
+    return nil
+}   // }}}
+
+// copyAttributes sets the owner, permissions and modification time of dst to
+// the ones in sfi.
+func copyAttributes(dst string, sfi os.FileInfo) error { // {{{
+    if err := copyOwner(dst, sfi); err != nil {
+        return err
+    }
+    // Chmod after chown as chown may clear the setuid and setgid bits.
+    if err := os.Chmod(dst, sfi.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+        return err
+    }
+    atime := time.Now()
+    if st, ok := sfi.Sys().(*syscall.Stat_t); ok {
+        atime = time.Unix(st.Atim.Unix())
+    }
+    return os.Chtimes(dst, atime, sfi.ModTime())
+}   // }}}
+
+// vim: set sts=4 ts=4 sw=4 et foldmethod=marker:
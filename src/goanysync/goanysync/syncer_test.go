@@ -0,0 +1,316 @@
+// Copyright (C) 2012 Esa Määttä <esa.maatta@iki.fi>
+// This file is released under the GNU GPL, version 3 or a later revision.
+// For further details see the COPYING file.
+
+package main
+
+import (
+    "os"
+    "path/filepath"
+    "reflect"
+    "sort"
+    "testing"
+    "time"
+)
+
+// writeFiles writes given files under dir, creating their parent dirs. A
+// file content ending with a slash creates a directory instead.
+func writeFiles(t *testing.T, dir string, files map[string]string) { // {{{
+    for name, content := range files {
+        p := filepath.Join(dir, name)
+        if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+            t.Fatal(err)
+        }
+        if name[len(name)-1] == '/' {
+            if err := os.MkdirAll(p, 0755); err != nil {
+                t.Fatal(err)
+            }
+            continue
+        }
+        if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+            t.Fatal(err)
+        }
+    }
+}   // }}}
+
+// treeContents returns the files under dir as a map from path relative to
+// dir to content. Directories end with a slash and have empty content, and
+// symlinks have "-> target" as their content.
+func treeContents(t *testing.T, dir string) map[string]string { // {{{
+    files := make(map[string]string)
+    err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+        if err != nil || p == dir {
+            return err
+        }
+        rel, err := filepath.Rel(dir, p)
+        if err != nil {
+            return err
+        }
+        switch {
+        case fi.IsDir():
+            files[rel+"/"] = ""
+        case fi.Mode()&os.ModeSymlink != 0:
+            target, err := os.Readlink(p)
+            if err != nil {
+                return err
+            }
+            files[rel] = "-> " + target
+        default:
+            b, err := os.ReadFile(p)
+            if err != nil {
+                return err
+            }
+            files[rel] = string(b)
+        }
+        return nil
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    return files
+}   // }}}
+
+// syncDirs returns a source dir with given files and an empty destination
+// dir, both in a temporary directory.
+func syncDirs(t *testing.T, files map[string]string) (string, string) { // {{{
+    tmp := t.TempDir()
+    src := filepath.Join(tmp, "src")
+    dst := filepath.Join(tmp, "dst")
+    for _, d := range []string{src, dst} {
+        if err := os.Mkdir(d, 0755); err != nil {
+            t.Fatal(err)
+        }
+    }
+    writeFiles(t, src, files)
+    return src, dst
+}   // }}}
+
+func TestGoSyncerCopy(t *testing.T) { // {{{
+    src, dst := syncDirs(t, map[string]string{
+        "a":      "a content",
+        "d/b":    "b content",
+        "d/e/":   "",
+        "d/e/f/": "",
+    })
+    if err := os.Symlink("d/b", filepath.Join(src, "l")); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.Chmod(filepath.Join(src, "a"), 0600); err != nil {
+        t.Fatal(err)
+    }
+    mtime := time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC)
+    if err := os.Chtimes(filepath.Join(src, "d", "b"), mtime, mtime); err != nil {
+        t.Fatal(err)
+    }
+
+    if err := (&goSyncer{}).Sync(src, dst, nil); err != nil {
+        t.Fatal(err)
+    }
+    if got, want := treeContents(t, dst), treeContents(t, src); !reflect.DeepEqual(got, want) {
+        t.Errorf("Synced tree = %q, want %q", got, want)
+    }
+    if fi, err := os.Stat(filepath.Join(dst, "a")); err != nil {
+        t.Error(err)
+    } else if fi.Mode().Perm() != 0600 {
+        t.Errorf("Synced a mode = %v, want %v", fi.Mode().Perm(), os.FileMode(0600))
+    }
+    if fi, err := os.Stat(filepath.Join(dst, "d", "b")); err != nil {
+        t.Error(err)
+    } else if !fi.ModTime().Equal(mtime) {
+        t.Errorf("Synced d/b modification time = %s, want %s", fi.ModTime(), mtime)
+    }
+
+    // A changed file is copied again
+    writeFiles(t, src, map[string]string{"a": "new content"})
+    if err := (&goSyncer{}).Sync(src, dst, nil); err != nil {
+        t.Fatal(err)
+    }
+    if got, want := treeContents(t, dst), treeContents(t, src); !reflect.DeepEqual(got, want) {
+        t.Errorf("Synced tree after change = %q, want %q", got, want)
+    }
+}   // }}}
+
+func TestGoSyncerDeleteExtra(t *testing.T) { // {{{
+    src, dst := syncDirs(t, map[string]string{
+        "a":   "a",
+        "d/b": "b",
+        "t":   "file in src",
+    })
+    writeFiles(t, dst, map[string]string{
+        "a":         "a",
+        "extra":     "extra",
+        "d/b":       "b",
+        "d/extra":   "extra",
+        "x/y/extra": "extra",
+        "t/inside":  "dir in dst",
+    })
+
+    if err := (&goSyncer{}).Sync(src, dst, nil); err != nil {
+        t.Fatal(err)
+    }
+    if got, want := treeContents(t, dst), treeContents(t, src); !reflect.DeepEqual(got, want) {
+        t.Errorf("Synced tree = %q, want %q", got, want)
+    }
+
+    // cp syncer deletes extra files with the go syncer before copying
+    writeFiles(t, dst, map[string]string{"d/extra": "extra", "x/extra": "extra"})
+    if err := (&goSyncer{}).deleteExtra(src, dst, "", true, nil); err != nil {
+        t.Fatal(err)
+    }
+    if got, want := treeContents(t, dst), treeContents(t, src); !reflect.DeepEqual(got, want) {
+        t.Errorf("Tree after deleteExtra = %q, want %q", got, want)
+    }
+}   // }}}
+
+func TestGoSyncerExcluded(t *testing.T) { // {{{
+    tests := []struct {
+        pattern string
+        rel     string
+        isDir   bool
+        want    bool
+    }{
+        {"*.tmp", "a.tmp", false, true},
+        {"*.tmp", "d/a.tmp", false, true},
+        {"*.tmp", "a.tmp/b", false, false},
+        {"cache", "cache", true, true},
+        {"cache", "d/cache", false, true},
+        {"cache/", "d/cache", true, true},
+        {"cache/", "d/cache", false, false},
+        {"/cache", "cache", true, true},
+        {"/cache", "d/cache", true, false},
+        {"d/cache", "d/cache", true, true},
+        {"d/cache", "x/d/cache", true, true},
+        {"d/cache", "xd/cache", true, false},
+        {"/d/*", "d/a", false, true},
+        {"/d/*", "d/a/b", false, false},
+    }
+    for _, test := range tests {
+        s := &goSyncer{[]string{test.pattern}}
+        if got := s.excluded(test.rel, test.isDir); got != test.want {
+            t.Errorf("excluded(%q, %t) with pattern %q = %t, want %t", test.rel, test.isDir, test.pattern, got, test.want)
+        }
+    }
+}   // }}}
+
+func TestGoSyncerExcludes(t *testing.T) { // {{{
+    src, dst := syncDirs(t, map[string]string{
+        "a":          "a",
+        "a.tmp":      "tmp",
+        "d/b.tmp":    "tmp",
+        "cache/c":    "c",
+        "d/cache/c":  "c",
+        "d/keep":     "keep",
+        "top/x":      "x",
+        "d/top/x":    "x",
+        "d/nested/n": "n",
+    })
+    // Excluded files in the destination are not deleted
+    writeFiles(t, dst, map[string]string{"old.tmp": "old"})
+
+    s := &goSyncer{[]string{"*.tmp", "cache/", "/top", "d/nested"}}
+    if err := s.Sync(src, dst, nil); err != nil {
+        t.Fatal(err)
+    }
+    var got []string
+    for p := range treeContents(t, dst) {
+        got = append(got, p)
+    }
+    sort.Strings(got)
+    want := []string{"a", "d/", "d/keep", "d/top/", "d/top/x", "old.tmp"}
+    if !reflect.DeepEqual(got, want) {
+        t.Errorf("Synced tree = %q, want %q", got, want)
+    }
+}   // }}}
+
+func TestGoSyncerKeepsHardLinks(t *testing.T) { // {{{
+    src, dst := syncDirs(t, map[string]string{"f": "old"})
+    if err := (&goSyncer{}).Sync(src, dst, nil); err != nil {
+        t.Fatal(err)
+    }
+    // Another hard link of a synced file, e.g. in a snapshot, must keep the
+    // old content when the file changes.
+    link := filepath.Join(filepath.Dir(dst), "link")
+    if err := os.Link(filepath.Join(dst, "f"), link); err != nil {
+        t.Fatal(err)
+    }
+    writeFiles(t, src, map[string]string{"f": "new content"})
+    if err := (&goSyncer{}).Sync(src, dst, nil); err != nil {
+        t.Fatal(err)
+    }
+    if b, err := os.ReadFile(filepath.Join(dst, "f")); err != nil || string(b) != "new content" {
+        t.Errorf("Synced f = %q, %v, want %q", b, err, "new content")
+    }
+    if b, err := os.ReadFile(link); err != nil || string(b) != "old" {
+        t.Errorf("Hard link of synced f = %q, %v, want %q", b, err, "old")
+    }
+    if matches, _ := filepath.Glob(filepath.Join(dst, ".goanysync-tmp.*")); len(matches) > 0 {
+        t.Errorf("Temporary files left behind: %q", matches)
+    }
+}   // }}}
+
+func TestGoSyncerReadOnlyDirs(t *testing.T) { // {{{
+    src, dst := syncDirs(t, map[string]string{
+        "ro/a":     "a",
+        "ro/sub/b": "b",
+    })
+    for _, d := range []string{"ro/sub", "ro"} {
+        if err := os.Chmod(filepath.Join(src, d), 0555); err != nil {
+            t.Fatal(err)
+        }
+    }
+    defer removeAll(filepath.Dir(src))
+
+    if err := (&goSyncer{}).Sync(src, dst, nil); err != nil {
+        t.Fatal(err)
+    }
+    if got, want := treeContents(t, dst), treeContents(t, src); !reflect.DeepEqual(got, want) {
+        t.Errorf("Synced tree = %q, want %q", got, want)
+    }
+    for _, d := range []string{"ro", "ro/sub"} {
+        if fi, err := os.Stat(filepath.Join(dst, d)); err != nil {
+            t.Error(err)
+        } else if fi.Mode().Perm() != 0555 {
+            t.Errorf("Synced %s mode = %v, want %v", d, fi.Mode().Perm(), os.FileMode(0555))
+        }
+    }
+
+    // Files are added to and removed from the read-only destination dirs
+    for _, d := range []string{"ro", "ro/sub"} {
+        if err := os.Chmod(filepath.Join(src, d), 0755); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := os.Remove(filepath.Join(src, "ro", "a")); err != nil {
+        t.Fatal(err)
+    }
+    writeFiles(t, src, map[string]string{"ro/sub/c": "c"})
+    for _, d := range []string{"ro/sub", "ro"} {
+        if err := os.Chmod(filepath.Join(src, d), 0555); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := (&goSyncer{}).Sync(src, dst, nil); err != nil {
+        t.Fatal(err)
+    }
+    if got, want := treeContents(t, dst), treeContents(t, src); !reflect.DeepEqual(got, want) {
+        t.Errorf("Synced tree after change = %q, want %q", got, want)
+    }
+
+    // Read-only trees are removed when the source no longer has them
+    for _, d := range []string{"ro/sub", "ro"} {
+        if err := os.Chmod(filepath.Join(src, d), 0755); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := os.RemoveAll(filepath.Join(src, "ro")); err != nil {
+        t.Fatal(err)
+    }
+    if err := (&goSyncer{}).Sync(src, dst, nil); err != nil {
+        t.Fatal(err)
+    }
+    if got := treeContents(t, dst); len(got) != 0 {
+        t.Errorf("Synced tree = %q, want it empty", got)
+    }
+}   // }}}
+
+// vim: set sts=4 ts=4 sw=4 et foldmethod=marker:
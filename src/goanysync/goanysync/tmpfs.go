@@ -0,0 +1,152 @@
+// Copyright (C) 2012 Esa Määttä <esa.maatta@iki.fi>
+// This file is released under the GNU GPL, version 3 or a later revision.
+// For further details see the COPYING file.
+
+package main
+
+import (
+    "errors"
+    "fmt"
+    "path"
+    "path/filepath"
+    "strings"
+    "syscall"
+)
+
+// File system types returned by statfs(2).
+const (
+    TMPFS_MAGIC = 0x01021994
+    RAMFS_MAGIC = 0x858458f6
+)
+
+// What is done when TMPFS is not on a RAM-backed file system.
+const (
+    TMPFS_CHECK_REFUSE = "refuse"
+    TMPFS_CHECK_WARN   = "warn"
+    TMPFS_CHECK_OFF    = "off"
+)
+
+// TmpfsCheckOptions are the options of the TMPFS file system check.
+type TmpfsCheckOptions struct {
+    // One of TMPFS_CHECK_REFUSE, TMPFS_CHECK_WARN or TMPFS_CHECK_OFF
+    action string
+    // Whether a file system on a zram device is accepted
+    zram bool
+}
+
+// readTmpfsCheckOptions reads TMPFS_CHECK and TMPFS_ZRAM options from given
+// option data.
+func readTmpfsCheckOptions(data map[string]*string) (topts TmpfsCheckOptions, err error) { // {{{
+    topts.action = TMPFS_CHECK_WARN
+    if v, ok := data["TMPFS_CHECK"]; ok {
+        switch topts.action = strings.TrimSpace(*v); topts.action {
+        case TMPFS_CHECK_REFUSE, TMPFS_CHECK_WARN, TMPFS_CHECK_OFF:
+        default:
+            err = errors.New("Invalid TMPFS_CHECK: " + *v)
+            return
+        }
+    }
+    if v, ok := data["TMPFS_ZRAM"]; ok {
+        if topts.zram, err = parseBool(*v); err != nil {
+            err = errors.New("TMPFS_ZRAM: " + err.Error())
+            return
+        }
+    }
+    return
+}   // }}}
+
+// TmpfsInfo describes the file system of the TMPFS path.
+type TmpfsInfo struct {
+    // The nearest existing dir of the TMPFS path
+    path  string
+    magic int64
+    mount mountEntry
+    size  int64
+    used  int64
+}
+
+// getTmpfsInfo returns the file system of given TMPFS path. As the TMPFS dir
+// does not have to exist, the file system of its nearest existing parent is
+// returned in that case.
+func getTmpfsInfo(tmpfs string) (info TmpfsInfo, err error) { // {{{
+    p := tmpfs
+    for !exists(p) {
+        p = path.Dir(p)
+    }
+    if info.path, err = filepath.EvalSymlinks(p); err != nil {
+        return
+    }
+    var fs syscall.Statfs_t
+    if err = syscall.Statfs(info.path, &fs); err != nil {
+        err = fmt.Errorf("Could not get the file system of TMPFS path '%s': %s", info.path, err)
+        return
+    }
+    info.magic = int64(fs.Type)
+    info.size = int64(fs.Blocks) * int64(fs.Bsize)
+    info.used = int64(fs.Blocks-fs.Bfree) * int64(fs.Bsize)
+    // The mount is only informational, the type is checked from the magic.
+    info.mount, _ = findMount(info.path)
+    return
+}   // }}}
+
+// ramBacked checks whether the file system is tmpfs or ramfs, or when zram is
+// allowed, a file system on a zram device.
+func (self TmpfsInfo) ramBacked(zram bool) bool { // {{{
+    if self.magic == TMPFS_MAGIC || self.magic == RAMFS_MAGIC {
+        return true
+    }
+    return zram && strings.HasPrefix(path.Base(self.mount.source), "zram")
+}   // }}}
+
+// fsType returns the name of the file system type.
+func (self TmpfsInfo) fsType() string { // {{{
+    switch {
+    case self.mount.fsType != "":
+        return self.mount.fsType
+    case self.magic == TMPFS_MAGIC:
+        return "tmpfs"
+    case self.magic == RAMFS_MAGIC:
+        return "ramfs"
+    }
+    return fmt.Sprintf("unknown (0x%x)", self.magic)
+}   // }}}
+
+// checkTmpfsFileSystem checks that given TMPFS path is on a RAM-backed file
+// system. Depending on the options a failed check is an error, a warning or
+// not checked at all.
+func checkTmpfsFileSystem(tmpfs string, topts TmpfsCheckOptions) error { // {{{
+    if topts.action == TMPFS_CHECK_OFF {
+        return nil
+    }
+    info, err := getTmpfsInfo(tmpfs)
+    if err != nil {
+        return err
+    }
+    if info.ramBacked(topts.zram) {
+        return nil
+    }
+    msg := fmt.Sprintf("TMPFS path '%s' is not on a RAM-backed file system but on %s.", tmpfs, info.fsType())
+    if topts.action == TMPFS_CHECK_WARN {
+        LOG.Warn("%s", msg)
+        return nil
+    }
+    return errors.New(msg)
+}   // }}}
+
+// printTmpfsInfo prints the file system type, size and usage of given TMPFS
+// path.
+func printTmpfsInfo(tmpfs string) { // {{{
+    info, err := getTmpfsInfo(tmpfs)
+    if err != nil {
+        fmt.Printf("TMPFS file system: %s\n", err)
+        return
+    }
+    var percent int64
+    if info.size > 0 {
+        percent = info.used * 100 / info.size
+    }
+    fmt.Printf("TMPFS file system: %s on %s, size %s, used %s (%d%%)\n",
+        info.fsType(), info.mount.point, formatSize(info.size), formatSize(info.used), percent)
+}   // }}}
+
+// vim: set sts=4 ts=4 sw=4 et foldmethod=marker: